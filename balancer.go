@@ -3,7 +3,15 @@
 // See LICENSE file for details.
 package balancers
 
+import (
+	"io"
+	"net/http"
+)
+
 // Balancer holds a list of connections to hosts.
+//
+// Balancers that hold resources, e.g. connections with heartbeats,
+// should also implement io.Closer. Use Close to release them.
 type Balancer interface {
 	// Get returns a connection that can be used for the next request.
 	Get() (Connection, error)
@@ -11,3 +19,63 @@ type Balancer interface {
 	// Connections is the list of available connections.
 	Connections() []Connection
 }
+
+// Close closes b if it implements io.Closer. It is a no-op otherwise.
+func Close(b Balancer) error {
+	if closer, ok := b.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Updater is implemented by balancers whose set of connections can be
+// changed at runtime, e.g. by service discovery. Connections are
+// identified by themselves, i.e. by pointer for connections like
+// HttpConnection, not by their URL.
+type Updater interface {
+	Balancer
+
+	// Add adds connections to the balancer. Connections that are already
+	// part of the balancer are ignored.
+	Add(conns ...Connection)
+
+	// Remove removes conns from the balancer. Removed connections that
+	// implement io.Closer are closed, e.g. to stop the heartbeat of a
+	// HttpConnection.
+	Remove(conns ...Connection)
+
+	// Replace atomically replaces the connections of the balancer by
+	// conns. Previous connections that are not part of conns and
+	// implement io.Closer are closed.
+	Replace(conns ...Connection)
+}
+
+// BalancerState describes the connections of a balancer as counted by its
+// last call of Get. Connections that are draining are not counted.
+type BalancerState struct {
+	// Healthy is the number of connections that are not broken.
+	Healthy int
+	// Total is the number of connections.
+	Total int
+	// Panicking is true if the balancer ignores the health of its
+	// connections, e.g. because too few of them are healthy.
+	Panicking bool
+}
+
+// HealthCheckTransporter is implemented by balancers that can check the
+// health of their connections with a given RoundTripper, like
+// roundrobin.Balancer. Transport passes its Base to such balancers.
+type HealthCheckTransporter interface {
+	// SetHealthCheckTransport sets the RoundTripper used by the health
+	// checks of the connections, including connections added later.
+	// It is called on the path of a request and must not block, e.g. by
+	// checking the connections.
+	SetHealthCheckTransport(rt http.RoundTripper)
+}
+
+// StateReporter is implemented by balancers that report their state
+// without counting their connections again.
+type StateReporter interface {
+	// State returns the state as counted by the last call of Get.
+	State() BalancerState
+}
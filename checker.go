@@ -0,0 +1,124 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Checker checks whether the host behind a connection is alive.
+// HttpConnection uses a Checker for its heartbeats.
+//
+// HealthCheck, TCPChecker, and ExecChecker are the built-in implementations.
+// Implement Checker yourself for protocol-specific checks, e.g. sending a
+// PING to a Redis server.
+type Checker interface {
+	// Check returns nil if the host at u is healthy and an error
+	// describing the problem otherwise.
+	Check(ctx context.Context, u *url.URL) error
+}
+
+// CheckerFunc is an adapter to allow the use of ordinary functions
+// as a Checker.
+type CheckerFunc func(ctx context.Context, u *url.URL) error
+
+// Check calls f(ctx, u).
+func (f CheckerFunc) Check(ctx context.Context, u *url.URL) error {
+	return f(ctx, u)
+}
+
+var (
+	// Ensure that the built-in checkers implement Checker.
+	_ Checker = (*HealthCheck)(nil)
+	_ Checker = (*TCPChecker)(nil)
+	_ Checker = (*ExecChecker)(nil)
+)
+
+// TCPChecker considers a host healthy if a TCP connection to it
+// can be established. If the URL has no port, the default port for
+// its scheme is used.
+type TCPChecker struct {
+	// Timeout is the time limit for establishing the connection.
+	// It defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// Check dials the host of u.
+func (tc *TCPChecker) Check(ctx context.Context, u *url.URL) error {
+	timeout := tc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return fmt.Errorf("tcp check: %v", err)
+	}
+	return conn.Close()
+}
+
+// ExecChecker considers a host healthy if a local command exits
+// with status 0. The command is passed the URL, host, and port of
+// the connection in the environment variables BALANCERS_URL,
+// BALANCERS_HOST, and BALANCERS_PORT.
+type ExecChecker struct {
+	// Command is the name or path of the command to run.
+	Command string
+
+	// Args are the arguments passed to Command.
+	Args []string
+
+	// Timeout is the time limit for the command to finish.
+	// It defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// Check runs the command for u.
+func (ec *ExecChecker) Check(ctx context.Context, u *url.URL) error {
+	timeout := ec.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, port, _ := net.SplitHostPort(hostPort(u))
+	cmd := exec.CommandContext(ctx, ec.Command, ec.Args...)
+	cmd.Env = append(os.Environ(),
+		"BALANCERS_URL="+u.String(),
+		"BALANCERS_HOST="+host,
+		"BALANCERS_PORT="+port,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("exec check: %v: %s", err, msg)
+		}
+		return fmt.Errorf("exec check: %v", err)
+	}
+	return nil
+}
+
+// hostPort returns the host and port of u, using the default port
+// of the scheme if u has no explicit port.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -11,6 +11,6 @@ import (
 // (like round-robin) to load balance between several HTTP servers.
 func NewClient(b Balancer) *http.Client {
 	return &http.Client{
-		Transport: &Transport{balancer: b},
+		Transport: NewTransport(b),
 	}
 }
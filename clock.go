@@ -0,0 +1,36 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"time"
+)
+
+// Clock is the source of time for heartbeats and other features that
+// depend on timing. Use a fake implementation like the one in the
+// clocktest package to write fast and deterministic tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc waits for the duration to elapse and then calls f
+	// in its own goroutine. It returns a Timer that can be used to
+	// cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event scheduled by a Clock.
+type Timer interface {
+	// Stop prevents the Timer from firing. It returns false if the
+	// timer has already expired or been stopped.
+	Stop() bool
+}
+
+// RealClock is the Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
@@ -0,0 +1,150 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/clocktest"
+)
+
+func TestHttpConnectionHeartbeatWithFakeClock(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewClock(start)
+	scheduler := balancers.NewScheduler().Clock(clock).Jitter(0)
+
+	var (
+		mu    sync.Mutex
+		count int
+		fail  bool
+	)
+	checker := balancers.CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		if fail {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	u, _ := url.Parse("http://127.0.0.1:12345")
+	conn := balancers.NewHttpConnection(u).
+		Scheduler(scheduler).
+		RiseFall(1, 2).
+		Checker(checker)
+	defer conn.Close()
+
+	advance := func(d time.Duration) {
+		clock.Advance(d)
+		scheduler.Wait()
+	}
+
+	advance(balancers.DefaultHeartbeatDuration - time.Second)
+	if count != 1 { // 1 on Checker
+		t.Fatalf("expected %d checks; got: %d", 1, count)
+	}
+	advance(time.Second)
+	if count != 2 {
+		t.Fatalf("expected %d checks; got: %d", 2, count)
+	}
+
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	advance(balancers.DefaultHeartbeatDuration)
+	if conn.IsBroken() {
+		t.Fatal("expected connection to not be broken after 1 failure")
+	}
+	advance(balancers.DefaultHeartbeatDuration)
+	if !conn.IsBroken() {
+		t.Fatal("expected connection to be broken after 2 failures")
+	}
+
+	state := conn.State()
+	if want := start.Add(3 * balancers.DefaultHeartbeatDuration); !state.LastCheck.Equal(want) {
+		t.Errorf("expected last check at %v; got: %v", want, state.LastCheck)
+	}
+	if count != 4 {
+		t.Errorf("expected %d checks; got: %d", 4, count)
+	}
+}
+
+// durationObserver records the durations of requests and health checks.
+type durationObserver struct {
+	balancers.NopObserver
+	mu       sync.Mutex
+	requests []time.Duration
+	checks   []time.Duration
+}
+
+func (o *durationObserver) RequestDone(r *http.Request, conn balancers.Connection, res *http.Response, err error, elapsed time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, elapsed)
+}
+
+func (o *durationObserver) HealthChecked(u *url.URL, err error, elapsed time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.checks = append(o.checks, elapsed)
+}
+
+// singleBalancer always returns its connection.
+type singleBalancer struct {
+	conn balancers.Connection
+}
+
+func (b singleBalancer) Get() (balancers.Connection, error)  { return b.conn, nil }
+func (b singleBalancer) Connections() []balancers.Connection { return []balancers.Connection{b.conn} }
+
+// roundTripperFunc is a http.RoundTripper.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestDurationsWithFakeClock(t *testing.T) {
+	clock := clocktest.NewClock(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	observer := &durationObserver{}
+	scheduler := balancers.NewScheduler().Clock(clock).Jitter(0).Observer(observer)
+
+	checker := balancers.CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		clock.Advance(2 * time.Second)
+		return nil
+	})
+	u, _ := url.Parse("http://127.0.0.1:12345")
+	conn := balancers.NewHttpConnection(u).Scheduler(scheduler).Checker(checker)
+	defer conn.Close()
+
+	transport := balancers.NewTransport(singleBalancer{conn: conn})
+	transport.Observer = observer
+	transport.Base = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		clock.Advance(3 * time.Second)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+	res, err := (&http.Client{Transport: transport}).Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if want, have := 2*time.Second, observer.checks[len(observer.checks)-1]; want != have {
+		t.Errorf("expected health check to take %v; got: %v", want, have)
+	}
+	if len(observer.requests) != 1 || observer.requests[0] != 3*time.Second {
+		t.Errorf("expected request to take %v; got: %v", 3*time.Second, observer.requests)
+	}
+	if want, have := 3*time.Second, conn.Stats().Latency.Max; want != have {
+		t.Errorf("expected latency %v; got: %v", want, have)
+	}
+}
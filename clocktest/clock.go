@@ -0,0 +1,98 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package clocktest provides a fake balancers.Clock for testing.
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+var (
+	// Ensure that Clock implements balancers.Clock.
+	_ balancers.Clock = (*Clock)(nil)
+)
+
+// Clock is a fake clock whose time only changes when calling Advance.
+type Clock struct {
+	mu     sync.Mutex // guards the following variables
+	now    time.Time
+	timers []*timer
+}
+
+// NewClock creates a new fake clock, set to the given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f when the clock is advanced by at least d.
+// Unlike time.AfterFunc, f is called synchronously by Advance.
+func (c *Clock) AfterFunc(d time.Duration, f func()) balancers.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and calls the functions of all
+// timers that expire in the meantime, in the order of their expiration.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.when
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Timers returns the number of timers that have not expired yet.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type timer struct {
+	clock *Clock
+	when  time.Time
+	f     func()
+}
+
+// Stop removes the timer from the clock.
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(1*time.Second, func() {
+		fired = append(fired, 1)
+		clock.AfterFunc(500*time.Millisecond, func() { fired = append(fired, 3) })
+	})
+	stopped := clock.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, 4) })
+	if !stopped.Stop() {
+		t.Error("expected timer to be stopped")
+	}
+	if stopped.Stop() {
+		t.Error("expected timer to be stopped already")
+	}
+
+	clock.Advance(time.Second)
+	if len(fired) != 1 {
+		t.Fatalf("expected %d timers to fire; got: %d", 1, len(fired))
+	}
+	if want, have := start.Add(time.Second), clock.Now(); !want.Equal(have) {
+		t.Errorf("expected %v; got: %v", want, have)
+	}
+
+	clock.Advance(10 * time.Second)
+	if len(fired) != 3 {
+		t.Fatalf("expected %d timers to fire; got: %d", 3, len(fired))
+	}
+	if fired[1] != 3 || fired[2] != 2 {
+		t.Errorf("expected timers to fire in order; got: %v", fired)
+	}
+	if want, have := start.Add(11*time.Second), clock.Now(); !want.Equal(have) {
+		t.Errorf("expected %v; got: %v", want, have)
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("expected %d timers; got: %d", 0, clock.Timers())
+	}
+}
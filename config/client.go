@@ -0,0 +1,202 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/discovery"
+
+	// Register the built-in algorithms
+	_ "github.com/olivere/balancers/roundrobin"
+)
+
+// algorithm returns the name of the balancer.
+func (c *Config) algorithm() string {
+	if c.Algorithm == "" {
+		return "roundrobin"
+	}
+	return c.Algorithm
+}
+
+// Client is a load-balanced HTTP client built from a document.
+type Client struct {
+	*http.Client
+
+	// Balancer distributes the requests of the client.
+	Balancer balancers.Updater
+
+	source interface{ Close() error }
+}
+
+// Close stops the discovery source, if any, and closes the connections
+// of the balancer.
+func (c *Client) Close() error {
+	if c.source != nil {
+		c.source.Close()
+	}
+	return balancers.Close(c.Balancer)
+}
+
+// NewClient creates the balancer, its connections, and the discovery
+// source of the document, and returns a client that uses them.
+// It returns an error if the document is invalid or the discovery
+// source fails to find the backends initially.
+func (c *Config) NewClient() (*Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	balancer, err := balancers.New(c.algorithm(), balancers.Options{
+		PanicThreshold: c.PanicThreshold,
+		Params:         c.Params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	transport := balancers.NewTransport(balancer)
+	transport.Retries = c.Retries
+	client := &Client{
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   parseDuration(c.Timeout),
+		},
+		Balancer: balancer,
+	}
+
+	if c.Discovery != nil {
+		source, err := c.newSource(balancer)
+		if err != nil {
+			balancers.Close(balancer)
+			return nil, err
+		}
+		client.source = source
+		return client, nil
+	}
+
+	// Check the backends concurrently, so that unreachable backends do
+	// not add up their timeouts
+	conns := make([]balancers.Connection, len(c.Backends))
+	var wg sync.WaitGroup
+	for i, b := range c.Backends {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			u, _ := url.Parse(b.URL)
+			conn := c.newConnection(u)
+			if b.Weight > 0 {
+				conn.SetWeight(b.Weight)
+			}
+			conn.SetPriority(b.Priority)
+			conn.SetLabels(b.Labels)
+			conns[i] = conn
+		}(i, b)
+	}
+	wg.Wait()
+	balancer.Replace(conns...)
+	return client, nil
+}
+
+// newConnection creates a connection with the health check of the document.
+// The connection is checked once, with the configured check.
+func (c *Config) newConnection(u *url.URL) *balancers.HttpConnection {
+	hc := c.HealthCheck
+	if hc == nil {
+		return balancers.NewHttpConnection(u)
+	}
+	opts := balancers.HttpConnectionOptions{Rise: hc.Rise, Fall: hc.Fall}
+	if hc.Interval != "" {
+		opts.HeartbeatDuration = parseDuration(hc.Interval)
+	}
+	if hc.Type == "tcp" {
+		opts.Checker = &balancers.TCPChecker{Timeout: parseDuration(hc.Timeout)}
+		return balancers.NewHttpConnectionWithOptions(u, opts)
+	}
+	check := &balancers.HealthCheck{
+		Path:      hc.Path,
+		Method:    hc.Method,
+		JSONField: hc.JSONField,
+		JSONValue: hc.JSONValue,
+		Timeout:   parseDuration(hc.Timeout),
+	}
+	if len(hc.Header) > 0 {
+		check.Header = make(http.Header)
+		for k, v := range hc.Header {
+			check.Header.Set(k, v)
+		}
+	}
+	for _, s := range hc.Statuses {
+		r, _ := parseStatusRange(s)
+		check.Statuses = append(check.Statuses, r)
+	}
+	if hc.Body != "" {
+		check.Body = regexp.MustCompile(hc.Body)
+	}
+	opts.Checker = check
+	return balancers.NewHttpConnectionWithOptions(u, opts)
+}
+
+// newSource creates the discovery source of the document.
+func (c *Config) newSource(updater balancers.Updater) (interface{ Close() error }, error) {
+	d := c.Discovery
+	interval := parseDuration(d.Interval)
+	newConnection := func(u *url.URL) balancers.Connection {
+		return c.newConnection(u)
+	}
+	switch d.Type {
+	case "dns":
+		return discovery.NewDNS(updater, discovery.DNSConfig{
+			URL:           d.URL,
+			Interval:      interval,
+			NewConnection: newConnection,
+		})
+	case "srv":
+		return discovery.NewSRV(updater, discovery.SRVConfig{
+			Service:       d.Service,
+			Proto:         d.Proto,
+			Name:          d.Name,
+			Scheme:        d.Scheme,
+			Interval:      interval,
+			NewConnection: newConnection,
+		})
+	case "file":
+		return discovery.NewFile(updater, discovery.FileConfig{
+			Path:          d.Path,
+			Unmarshal:     c.unmarshal,
+			Interval:      interval,
+			NewConnection: newConnection,
+		})
+	case "consul":
+		return discovery.NewConsul(updater, discovery.ConsulConfig{
+			Address:       d.Address,
+			Service:       d.Service,
+			Tag:           d.Tag,
+			Datacenter:    d.Datacenter,
+			Token:         d.Token,
+			Scheme:        d.Scheme,
+			NewConnection: newConnection,
+		})
+	case "kubernetes":
+		return discovery.NewKubernetes(updater, discovery.KubernetesConfig{
+			Namespace:     d.Namespace,
+			Service:       d.Service,
+			Port:          d.Port,
+			Scheme:        d.Scheme,
+			Token:         d.Token,
+			NewConnection: newConnection,
+		})
+	default: // "eds"
+		return discovery.NewEDS(updater, discovery.EDSConfig{
+			Server:        d.Server,
+			Cluster:       d.Cluster,
+			NodeID:        d.NodeID,
+			Scheme:        d.Scheme,
+			Interval:      interval,
+			NewConnection: newConnection,
+		})
+	}
+}
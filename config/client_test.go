@@ -0,0 +1,258 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBackend starts a server that responds with its name and reports
+// healthy on /health.
+func newBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, name)
+	}))
+}
+
+func get(t *testing.T, client *Client) string {
+	t.Helper()
+	res, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestNewClient(t *testing.T) {
+	s1, s2 := newBackend("s1"), newBackend("s2")
+	defer s1.Close()
+	defer s2.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg, err := Parse([]byte(fmt.Sprintf(`{
+		"backends": [
+			{"url": %q, "weight": 2, "labels": {"zone": "eu-1"}},
+			{"url": %q},
+			{"url": %q, "priority": 1}
+		],
+		"healthCheck": {"path": "/health", "statuses": ["204"], "interval": "1h"},
+		"retries": 1,
+		"timeout": "5s"
+	}`, s1.URL, down.URL, s2.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if want, have := 5*time.Second, client.Timeout; want != have {
+		t.Errorf("expected timeout %v; got: %v", want, have)
+	}
+	conns := client.Balancer.Connections()
+	if want, have := 3, len(conns); want != have {
+		t.Fatalf("expected %d connections; got: %d", want, have)
+	}
+	if conns[0].IsBroken() || !conns[1].IsBroken() || conns[2].IsBroken() {
+		t.Errorf("expected only the second connection to be broken")
+	}
+
+	// The broken backend is skipped, and s2 is only used if s1 is down
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		bodies = append(bodies, get(t, client))
+	}
+	if want, have := "[s1 s1 s1]", fmt.Sprint(bodies); want != have {
+		t.Errorf("expected responses %s; got: %s", want, have)
+	}
+}
+
+func TestNewClientRetries(t *testing.T) {
+	s1 := newBackend("s1")
+	defer s1.Close()
+
+	// A listener that hangs up passes TCP checks, but requests fail
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := &Config{
+		Backends:    []Backend{{URL: "http://" + ln.Addr().String()}, {URL: s1.URL}},
+		HealthCheck: &HealthCheck{Type: "tcp", Interval: "1h"},
+		Retries:     1,
+	}
+	client, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, conn := range client.Balancer.Connections() {
+		if conn.IsBroken() {
+			t.Errorf("expected %s to be healthy", conn.URL())
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if want, have := "s1", get(t, client); want != have {
+			t.Errorf("expected response %q; got: %q", want, have)
+		}
+	}
+}
+
+func TestNewClientChecksBackendsConcurrently(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var backends []Backend
+	for i := 0; i < 5; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+		}))
+		defer server.Close()
+		backends = append(backends, Backend{URL: server.URL})
+	}
+
+	cfg := &Config{
+		Backends:    backends,
+		HealthCheck: &HealthCheck{Interval: "1h"},
+	}
+	start := time.Now()
+	client, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if elapsed := time.Since(start); elapsed >= time.Duration(len(backends))*delay {
+		t.Errorf("expected backends to be checked concurrently; took %v", elapsed)
+	}
+	if want, have := len(backends), len(client.Balancer.Connections()); want != have {
+		t.Errorf("expected %d connections; got: %d", want, have)
+	}
+}
+
+func TestNewClientChecksBackendsOnce(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	for _, hc := range []*HealthCheck{
+		{Path: "/health", Interval: "1h"},
+		{Type: "tcp", Interval: "1h"},
+	} {
+		mu.Lock()
+		paths = make(map[string]int)
+		mu.Unlock()
+		cfg := &Config{Backends: []Backend{{URL: server.URL}}, HealthCheck: hc}
+		client, err := cfg.NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		want := "map[]"
+		if hc.Type != "tcp" {
+			want = "map[/health:1]"
+		}
+		mu.Lock()
+		if have := fmt.Sprint(paths); want != have {
+			t.Errorf("expected requests %s with %q check; got: %s", want, hc.Type, have)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestNewClientWithDiscovery(t *testing.T) {
+	s1, s2 := newBackend("s1"), newBackend("s2")
+	defer s1.Close()
+	defer s2.Close()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.json")
+	data := fmt.Sprintf(`{"backends": [{"url": %q}, {"url": %q, "weight": 3}]}`, s1.URL, s2.URL)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Parse([]byte(fmt.Sprintf(`{
+		"discovery": {"type": "file", "path": %q},
+		"healthCheck": {"path": "/health", "statuses": ["204"]}
+	}`, path)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var urls []string
+	for _, conn := range client.Balancer.Connections() {
+		urls = append(urls, conn.URL().String())
+		if conn.IsBroken() {
+			t.Errorf("expected %s to be healthy", conn.URL())
+		}
+	}
+	sort.Strings(urls)
+	expected := []string{s1.URL, s2.URL}
+	sort.Strings(expected)
+	if want, have := fmt.Sprint(expected), fmt.Sprint(urls); want != have {
+		t.Errorf("expected connections %s; got: %s", want, have)
+	}
+
+	// Closing the client stops the source
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewClientRejectsInvalidConfig(t *testing.T) {
+	cfg := &Config{Backends: []Backend{{URL: "localhost"}}}
+	if _, err := cfg.NewClient(); err == nil {
+		t.Fatal("expected error")
+	}
+	cfg = &Config{Backends: []Backend{{URL: "http://localhost"}}, Params: map[string]string{"choices": "2"}}
+	if _, err := cfg.NewClient(); err == nil {
+		t.Fatal("expected error")
+	}
+	cfg = &Config{Discovery: &Discovery{Type: "file", Path: "/does/not/exist"}}
+	if _, err := cfg.NewClient(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+/*
+Package config builds a load-balanced HTTP client from a JSON or YAML
+document, e.g.:
+
+	{
+	  "algorithm": "roundrobin",
+	  "backends": [
+	    {"url": "http://10.0.0.1:9200", "weight": 2, "labels": {"zone": "eu-1"}},
+	    {"url": "http://10.0.0.2:9200"}
+	  ],
+	  "healthCheck": {"path": "/_cluster/health", "interval": "10s", "fall": 3},
+	  "retries": 2,
+	  "timeout": "30s"
+	}
+
+Instead of a static list of backends, a document may configure a
+discovery source:
+
+	{
+	  "discovery": {"type": "dns", "url": "http://search.default.svc:9200"}
+	}
+
+The algorithm is looked up with balancers.New. To use an algorithm
+other than the built-in ones, import its package to register it.
+
+Use it like this:
+
+	cfg, err := config.Load("balancer.json", nil)
+	...
+	client, err := cfg.NewClient()
+	...
+	defer client.Close()
+	res, err := client.Get("/_search")
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/discovery"
+)
+
+// Config is a document that describes a load-balanced HTTP client.
+type Config struct {
+	// Algorithm is the name of the balancer, as registered with
+	// balancers.Register. It defaults to "roundrobin".
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+
+	// PanicThreshold and Params configure the balancer; see
+	// balancers.Options. Params must be accepted by the algorithm; see
+	// balancers.AlgorithmParams.
+	PanicThreshold float64           `json:"panicThreshold,omitempty" yaml:"panicThreshold,omitempty"`
+	Params         map[string]string `json:"params,omitempty" yaml:"params,omitempty"`
+
+	// Backends is the static list of backends. It must be empty if
+	// Discovery is set.
+	Backends []Backend `json:"backends,omitempty" yaml:"backends,omitempty"`
+
+	// HealthCheck configures the health checks of the backends.
+	// It defaults to a GET request to the URL of every backend.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+
+	// Retries is the number of times a failed request is sent to
+	// another backend. See balancers.Transport for details.
+	Retries int `json:"retries,omitempty" yaml:"retries,omitempty"`
+
+	// Timeout limits the time of a request, including retries and
+	// reading the response body, e.g. "30s". It defaults to no timeout.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Discovery configures a source for the backends.
+	Discovery *Discovery `json:"discovery,omitempty" yaml:"discovery,omitempty"`
+
+	// unmarshal is the function the document was decoded with.
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// Backend is a single backend.
+type Backend struct {
+	URL      string            `json:"url" yaml:"url"`
+	Weight   int               `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Priority int               `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// HealthCheck configures the health checks of the backends.
+type HealthCheck struct {
+	// Type is "http" (the default) or "tcp". The remaining fields up to
+	// JSONValue only apply to "http"; see balancers.HealthCheck.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	Path      string            `json:"path,omitempty" yaml:"path,omitempty"`
+	Method    string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Header    map[string]string `json:"header,omitempty" yaml:"header,omitempty"`
+	Statuses  []string          `json:"statuses,omitempty" yaml:"statuses,omitempty"` // e.g. "200" or "200-299"
+	Body      string            `json:"body,omitempty" yaml:"body,omitempty"`         // regular expression
+	JSONField string            `json:"jsonField,omitempty" yaml:"jsonField,omitempty"`
+	JSONValue string            `json:"jsonValue,omitempty" yaml:"jsonValue,omitempty"`
+
+	// Interval is the time between two checks, e.g. "10s".
+	// It defaults to balancers.DefaultHeartbeatDuration.
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// Timeout is the time limit for a single check, e.g. "2s".
+	// It defaults to balancers.DefaultHealthCheckTimeout.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Rise and Fall are the numbers of consecutive checks that mark a
+	// backend as healthy or broken. Both default to 1.
+	Rise int `json:"rise,omitempty" yaml:"rise,omitempty"`
+	Fall int `json:"fall,omitempty" yaml:"fall,omitempty"`
+}
+
+// Discovery configures a source for the backends. Which fields apply
+// depends on the type of the source:
+//
+//	dns:        url
+//	srv:        service, proto, name
+//	file:       path
+//	consul:     service, address, tag, datacenter, token
+//	kubernetes: service, namespace, port, token
+//	eds:        cluster, server, nodeId
+//
+// See the corresponding configuration of the discovery package for
+// details. Interval applies to dns, srv, file, and eds; the others
+// watch for changes. Scheme applies to all types but dns and file,
+// which take it from the URLs of the backends.
+type Discovery struct {
+	Type       string `json:"type" yaml:"type"`
+	Interval   string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Scheme     string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	URL        string `json:"url,omitempty" yaml:"url,omitempty"`
+	Service    string `json:"service,omitempty" yaml:"service,omitempty"`
+	Proto      string `json:"proto,omitempty" yaml:"proto,omitempty"`
+	Name       string `json:"name,omitempty" yaml:"name,omitempty"`
+	Path       string `json:"path,omitempty" yaml:"path,omitempty"`
+	Address    string `json:"address,omitempty" yaml:"address,omitempty"`
+	Tag        string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Datacenter string `json:"datacenter,omitempty" yaml:"datacenter,omitempty"`
+	Token      string `json:"token,omitempty" yaml:"token,omitempty"`
+	Namespace  string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Port       string `json:"port,omitempty" yaml:"port,omitempty"`
+	Cluster    string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	Server     string `json:"server,omitempty" yaml:"server,omitempty"`
+	NodeID     string `json:"nodeId,omitempty" yaml:"nodeId,omitempty"`
+}
+
+// Error is a problem with a field of a document.
+type Error struct {
+	// Field is the path of the field, e.g. "backends[1].url".
+	Field string
+	// Message describes the problem.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Errors is the list of problems found in a document.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "config: " + strings.Join(msgs, "; ")
+}
+
+// Load reads the document in the given file and validates it.
+// See Parse for unmarshal.
+func Load(path string, unmarshal func(data []byte, v interface{}) error) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, unmarshal)
+}
+
+// Parse decodes the document and validates it. If the document is
+// invalid, the error is of type Errors. unmarshal decodes the document;
+// if nil, the document must be JSON. Pass e.g. yaml.Unmarshal of
+// gopkg.in/yaml.v3 to read YAML. The same function is used to read the
+// file of a file discovery source.
+//
+// Unknown fields are rejected whatever the format. To this end, the
+// document is decoded by unmarshal into an interface{}, which must
+// consist of maps with string keys like those of yaml.v3, and then
+// decoded again like JSON.
+func Parse(data []byte, unmarshal func(data []byte, v interface{}) error) (*Config, error) {
+	cfg := &Config{unmarshal: unmarshal}
+	if err := discovery.DecodeStrict(unmarshal, data, cfg); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the document and returns all problems as Errors,
+// or nil if it is valid.
+func (c *Config) Validate() error {
+	var errs Errors
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, &Error{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if params, known := balancers.AlgorithmParams(c.algorithm()); !known {
+		add("algorithm", "unknown algorithm %q (registered: %s)", c.Algorithm, strings.Join(balancers.Algorithms(), ", "))
+	} else {
+		names := make([]string, 0, len(c.Params))
+		for name := range c.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if i := sort.SearchStrings(params, name); i == len(params) || params[i] != name {
+				add("params."+name, "not accepted by algorithm %q", c.algorithm())
+			}
+		}
+	}
+	if c.PanicThreshold < 0 || c.PanicThreshold > 1 {
+		add("panicThreshold", "must be between 0 and 1")
+	}
+	if len(c.Backends) == 0 && c.Discovery == nil {
+		add("backends", "must not be empty without discovery")
+	}
+	if len(c.Backends) > 0 && c.Discovery != nil {
+		add("backends", "must be empty with discovery")
+	}
+	for i, b := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		if msg := validateURL(b.URL); msg != "" {
+			add(field+".url", "%s", msg)
+		}
+		if b.Weight < 0 {
+			add(field+".weight", "must not be negative")
+		}
+	}
+	if hc := c.HealthCheck; hc != nil {
+		switch hc.Type {
+		case "", "http":
+			for i, s := range hc.Statuses {
+				if _, err := parseStatusRange(s); err != nil {
+					add(fmt.Sprintf("healthCheck.statuses[%d]", i), "%v", err)
+				}
+			}
+			if _, err := regexp.Compile(hc.Body); err != nil {
+				add("healthCheck.body", "invalid regular expression: %v", err)
+			}
+		case "tcp":
+			if hc.Path != "" || hc.Method != "" || len(hc.Header) > 0 || len(hc.Statuses) > 0 ||
+				hc.Body != "" || hc.JSONField != "" || hc.JSONValue != "" {
+				add("healthCheck", "HTTP settings do not apply to type \"tcp\"")
+			}
+		default:
+			add("healthCheck.type", "unknown type %q", hc.Type)
+		}
+		if msg := validateDuration(hc.Interval); msg != "" {
+			add("healthCheck.interval", "%s", msg)
+		}
+		if msg := validateDuration(hc.Timeout); msg != "" {
+			add("healthCheck.timeout", "%s", msg)
+		}
+		if hc.Rise < 0 {
+			add("healthCheck.rise", "must not be negative")
+		}
+		if hc.Fall < 0 {
+			add("healthCheck.fall", "must not be negative")
+		}
+	}
+	if c.Retries < 0 {
+		add("retries", "must not be negative")
+	}
+	if msg := validateDuration(c.Timeout); msg != "" {
+		add("timeout", "%s", msg)
+	}
+	if d := c.Discovery; d != nil {
+		required := map[string][]string{
+			"dns":        {"url"},
+			"srv":        {"service", "proto", "name"},
+			"file":       {"path"},
+			"consul":     {"service"},
+			"kubernetes": {"service"},
+			"eds":        {"cluster", "server"},
+		}
+		values := map[string]string{
+			"url":     d.URL,
+			"service": d.Service,
+			"proto":   d.Proto,
+			"name":    d.Name,
+			"path":    d.Path,
+			"cluster": d.Cluster,
+			"server":  d.Server,
+		}
+		if fields, ok := required[d.Type]; !ok {
+			add("discovery.type", "unknown type %q", d.Type)
+		} else {
+			for _, field := range fields {
+				if values[field] == "" {
+					add("discovery."+field, "is required for type %q", d.Type)
+				}
+			}
+		}
+		if d.Type == "dns" && d.URL != "" {
+			if msg := validateURL(d.URL); msg != "" {
+				add("discovery.url", "%s", msg)
+			}
+		}
+		if msg := validateDuration(d.Interval); msg != "" {
+			add("discovery.interval", "%s", msg)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateURL returns a description of the problem with an URL of a
+// backend, or an empty string if it is valid.
+func validateURL(rawurl string) string {
+	if rawurl == "" {
+		return "is required"
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Sprintf("invalid URL %q", rawurl)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Sprintf("URL %q must have a scheme and a host", rawurl)
+	}
+	return ""
+}
+
+// validateDuration returns a description of the problem with an optional
+// duration, or an empty string if it is valid.
+func validateDuration(s string) string {
+	if s == "" {
+		return ""
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Sprintf("invalid duration %q", s)
+	}
+	if d <= 0 {
+		return "must be positive"
+	}
+	return ""
+}
+
+// parseDuration parses a duration that has been validated. It returns 0
+// for an empty string.
+func parseDuration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+// parseStatusRange parses a status code or range like "200-299".
+func parseStatusRange(s string) (r balancers.StatusRange, err error) {
+	min, max := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		min, max = s[:i], s[i+1:]
+	}
+	if r.Min, err = strconv.Atoi(strings.TrimSpace(min)); err == nil {
+		r.Max, err = strconv.Atoi(strings.TrimSpace(max))
+	}
+	if err != nil || r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+		return r, fmt.Errorf("invalid status code range %q", s)
+	}
+	return r, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+		"backends": [
+			{"url": "http://10.0.0.1:9200", "weight": 2, "labels": {"zone": "eu-1"}},
+			{"url": "http://10.0.0.2:9200"}
+		],
+		"healthCheck": {"path": "/health", "statuses": ["200-299", "404"], "interval": "10s", "fall": 3},
+		"retries": 2,
+		"timeout": "30s"
+	}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(cfg.Backends); want != have {
+		t.Fatalf("expected %d backends; got: %d", want, have)
+	}
+	if want, have := "eu-1", cfg.Backends[0].Labels["zone"]; want != have {
+		t.Errorf("expected zone %q; got: %q", want, have)
+	}
+	if want, have := 3, cfg.HealthCheck.Fall; want != have {
+		t.Errorf("expected fall %d; got: %d", want, have)
+	}
+	if want, have := "roundrobin", cfg.algorithm(); want != have {
+		t.Errorf("expected algorithm %q; got: %q", want, have)
+	}
+}
+
+func TestParseRejectsUnknownFields(t *testing.T) {
+	// json.Unmarshal accepts unknown fields, like yaml.Unmarshal
+	for _, unmarshal := range []func([]byte, interface{}) error{nil, json.Unmarshal} {
+		_, err := Parse([]byte(`{"backends": [{"url": "http://localhost", "wieght": 2}]}`), unmarshal)
+		if err == nil || !strings.Contains(err.Error(), `unknown field "wieght"`) {
+			t.Errorf("expected unknown field error; got: %v", err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		Doc    string
+		Errors []string
+	}{
+		{
+			`{}`,
+			[]string{"backends: must not be empty without discovery"},
+		},
+		{
+			`{"algorithm": "random", "backends": [{"url": "http://localhost"}, {"url": "localhost:9200", "weight": -1}, {}]}`,
+			[]string{
+				`algorithm: unknown algorithm "random" (registered: roundrobin)`,
+				`backends[1].url: URL "localhost:9200" must have a scheme and a host`,
+				`backends[1].weight: must not be negative`,
+				`backends[2].url: is required`,
+			},
+		},
+		{
+			`{"backends": [{"url": "http://localhost"}], "retries": -1, "timeout": "soon", "panicThreshold": 2,
+			  "healthCheck": {"statuses": ["200", "299-200", "ok"], "body": "(", "interval": "-1s", "rise": -1}}`,
+			[]string{
+				`panicThreshold: must be between 0 and 1`,
+				`healthCheck.statuses[1]: invalid status code range "299-200"`,
+				`healthCheck.statuses[2]: invalid status code range "ok"`,
+				"healthCheck.body: invalid regular expression: error parsing regexp: missing closing ): `(`",
+				`healthCheck.interval: must be positive`,
+				`healthCheck.rise: must not be negative`,
+				`retries: must not be negative`,
+				`timeout: invalid duration "soon"`,
+			},
+		},
+		{
+			`{"backends": [{"url": "http://localhost"}], "params": {"choices": "2", "bias": "1"}}`,
+			[]string{
+				`params.bias: not accepted by algorithm "roundrobin"`,
+				`params.choices: not accepted by algorithm "roundrobin"`,
+			},
+		},
+		{
+			`{"backends": [{"url": "http://localhost"}], "healthCheck": {"type": "tcp", "path": "/health"}}`,
+			[]string{`healthCheck: HTTP settings do not apply to type "tcp"`},
+		},
+		{
+			`{"backends": [{"url": "http://localhost"}], "discovery": {"type": "srv", "service": "http"}}`,
+			[]string{
+				`backends: must be empty with discovery`,
+				`discovery.proto: is required for type "srv"`,
+				`discovery.name: is required for type "srv"`,
+			},
+		},
+		{
+			`{"discovery": {"type": "zookeeper", "interval": "1m"}}`,
+			[]string{`discovery.type: unknown type "zookeeper"`},
+		},
+		{
+			`{"discovery": {"type": "dns", "url": "search:9200"}}`,
+			[]string{`discovery.url: URL "search:9200" must have a scheme and a host`},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.Doc), nil)
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("expected Errors for %s; got: %v", test.Doc, err)
+			continue
+		}
+		if len(errs) != len(test.Errors) {
+			t.Errorf("expected %d errors for %s; got: %v", len(test.Errors), test.Doc, errs)
+			continue
+		}
+		for i, want := range test.Errors {
+			if have := errs[i].Error(); want != have {
+				t.Errorf("expected error %q; got: %q", want, have)
+			}
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	err := Errors{
+		{Field: "backends[0].url", Message: "is required"},
+		{Field: "retries", Message: "must not be negative"},
+	}
+	if want, have := "config: backends[0].url: is required; retries: must not be negative", err.Error(); want != have {
+		t.Errorf("expected %q; got: %q", want, have)
+	}
+}
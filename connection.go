@@ -4,6 +4,9 @@
 package balancers
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"sync"
@@ -20,6 +23,58 @@ type Connection interface {
 	IsBroken() bool
 }
 
+// Drainer is implemented by connections that can be drained. A draining
+// connection must not be returned by a Balancer for new requests, while
+// requests already in flight complete normally.
+type Drainer interface {
+	// IsDraining returns true if the connection is draining.
+	IsDraining() bool
+}
+
+// Weighted is implemented by connections with a relative weight.
+// A balancer may send proportionally more requests to connections with
+// a higher weight. Connections that do not implement Weighted have a
+// weight of 1.
+type Weighted interface {
+	Weight() int
+}
+
+// Prioritized is implemented by connections with a priority. A balancer
+// may only use the connections with the lowest priority value that are
+// available, and fail over to the next priority if there are none.
+// Connections that do not implement Prioritized have a priority of 0.
+type Prioritized interface {
+	Priority() int
+}
+
+// Labeled is implemented by connections with labels, e.g. the zone
+// of the host.
+type Labeled interface {
+	Labels() map[string]string
+}
+
+// Tracker is implemented by connections that keep track of the requests
+// in flight. Transport calls Acquire before a request is sent to the
+// connection, and Release when the response body has been read or closed,
+// or the request has failed.
+type Tracker interface {
+	Acquire()
+	Release()
+}
+
+var (
+	// Ensure that HttpConnection implements the optional interfaces.
+	_ Notifier    = (*HttpConnection)(nil)
+	_ Drainer     = (*HttpConnection)(nil)
+	_ Tracker     = (*HttpConnection)(nil)
+	_ Weighted    = (*HttpConnection)(nil)
+	_ Prioritized = (*HttpConnection)(nil)
+	_ Labeled     = (*HttpConnection)(nil)
+
+	_ RequestRecorder = (*HttpConnection)(nil)
+	_ StatsProvider   = (*HttpConnection)(nil)
+)
+
 // HttpConnection is a HTTP connection to a host.
 // It implements the Connection interface and can be used by balancer
 // implementations.
@@ -28,81 +83,391 @@ type HttpConnection struct {
 	url               *url.URL
 	broken            bool
 	heartbeatDuration time.Duration
-	heartbeatStop     chan bool
+	scheduler         *Scheduler
+	sub               *subscription // current heartbeat subscription
+	closed            bool
+	checker           Checker
+	transport         http.RoundTripper
+	rise              int       // consecutive passes to become healthy
+	fall              int       // consecutive failures to become broken
+	successes         int       // consecutive passed checks
+	failures          int       // consecutive failed checks
+	lastCheck         time.Time // time of the last check
+	lastErr           error     // error of the last check
+	subscribers       map[uint64]func(HealthEvent)
+	nextSubscriber    uint64
+	events            []HealthEvent // changes yet to be passed to subscribers
+	reporting         bool          // a goroutine passes events to subscribers
+	draining          bool
+	weight            int
+	priority          int
+	labels            map[string]string
+	inflight          int           // number of requests in flight
+	idle              chan struct{} // closed when inflight drops to 0
+	stats             requestStats
+	logger            *slog.Logger
+}
+
+// ConnectionState is a snapshot of the health of a HttpConnection.
+type ConnectionState struct {
+	// Broken is true if the connection is currently considered broken.
+	Broken bool
+	// ConsecutiveSuccesses is the number of checks passed in a row.
+	ConsecutiveSuccesses int
+	// ConsecutiveFailures is the number of checks failed in a row.
+	ConsecutiveFailures int
+	// LastCheck is the time of the last check.
+	LastCheck time.Time
+	// LastError is the error returned by the last check, if any.
+	LastError error
 }
 
 // NewHttpConnection creates a new HTTP connection to the given URL.
+// It checks the connection immediately and then periodically
+// by means of the DefaultScheduler.
 func NewHttpConnection(url *url.URL) *HttpConnection {
-	c := &HttpConnection{
+	c := newHttpConnection(url)
+	c.start()
+	return c
+}
+
+// HttpConnectionOptions configure a connection created by
+// NewHttpConnectionWithOptions. The zero value uses the same defaults
+// as NewHttpConnection.
+type HttpConnectionOptions struct {
+	// Checker is used for the checks of the connection. It defaults to
+	// a HTTP GET request to the URL of the connection (see Checker).
+	Checker Checker
+	// Transport is used by HTTP health checks (see Transport).
+	Transport http.RoundTripper
+	// HeartbeatDuration defaults to DefaultHeartbeatDuration.
+	HeartbeatDuration time.Duration
+	// Scheduler defaults to DefaultScheduler.
+	Scheduler *Scheduler
+	// Rise and Fall default to 1 (see RiseFall).
+	Rise, Fall int
+}
+
+// NewHttpConnectionWithOptions creates a new HTTP connection to the given
+// URL with the given options. Unlike configuring a connection created by
+// NewHttpConnection, it checks the connection only once, with the
+// configured Checker, before it is checked periodically.
+func NewHttpConnectionWithOptions(url *url.URL, opts HttpConnectionOptions) *HttpConnection {
+	c := newHttpConnection(url)
+	c.checker = opts.Checker
+	c.transport = opts.Transport
+	if opts.HeartbeatDuration > 0 {
+		c.heartbeatDuration = opts.HeartbeatDuration
+	}
+	if opts.Scheduler != nil {
+		c.scheduler = opts.Scheduler
+	}
+	if opts.Rise > 1 {
+		c.rise = opts.Rise
+	}
+	if opts.Fall > 1 {
+		c.fall = opts.Fall
+	}
+	c.start()
+	return c
+}
+
+// newHttpConnection creates a new HTTP connection with default settings
+// that is not checked yet.
+func newHttpConnection(url *url.URL) *HttpConnection {
+	return &HttpConnection{
 		url:               url,
 		heartbeatDuration: DefaultHeartbeatDuration,
-		heartbeatStop:     make(chan bool),
+		scheduler:         DefaultScheduler,
+		rise:              1,
+		fall:              1,
+		weight:            1,
 	}
+}
+
+// start checks the connection and registers its heartbeat.
+func (c *HttpConnection) start() {
 	c.checkBroken()
-	go c.heartbeat()
-	return c
+	c.Lock()
+	c.heartbeat()
+	c.Unlock()
 }
 
-// Close this connection.
+// Close this connection. It stops the heartbeat.
 func (c *HttpConnection) Close() error {
 	c.Lock()
-	defer c.Unlock()
-	c.heartbeatStop <- true // wait for heartbeat ticker to stop
-	c.broken = false
+	c.scheduler.unsubscribe(c.sub)
+	c.sub = nil
+	c.closed = true
+	ev := c.setBroken(false, "connection closed", nil)
+	c.Unlock()
+	c.notify(ev)
 	return nil
 }
 
 // HeartbeatDuration sets the duration in which the connection is checked.
+// The connection keeps its state, e.g. it stays broken until the next
+// check passes.
 func (c *HttpConnection) HeartbeatDuration(d time.Duration) *HttpConnection {
 	c.Lock()
 	defer c.Unlock()
-	c.heartbeatStop <- true // wait for heartbeat ticker to stop
-	c.broken = false
 	c.heartbeatDuration = d
-	go c.heartbeat()
+	c.heartbeat()
+	return c
+}
+
+// Scheduler sets the Scheduler that runs the heartbeats of the connection.
+func (c *HttpConnection) Scheduler(s *Scheduler) *HttpConnection {
+	c.Lock()
+	defer c.Unlock()
+	if s == nil {
+		s = DefaultScheduler
+	}
+	c.scheduler.unsubscribe(c.sub)
+	c.sub = nil
+	c.scheduler = s
+	c.heartbeat()
+	return c
+}
+
+// HealthCheck configures the HTTP health check of the connection.
+// It is a shortcut for Checker(hc).
+func (c *HttpConnection) HealthCheck(hc *HealthCheck) *HttpConnection {
+	if hc == nil {
+		return c.Checker(nil)
+	}
+	return c.Checker(hc)
+}
+
+// Transport sets the RoundTripper used by HTTP health checks. It applies
+// to the default health check and to a HealthCheck without a Transport
+// of its own. Use this to check the connection with the same TLS and
+// proxy settings that are used for requests, e.g. the Base of the
+// balancer's Transport. The connection is checked immediately.
+func (c *HttpConnection) Transport(rt http.RoundTripper) *HttpConnection {
+	c.Lock()
+	c.transport = rt
+	c.successes, c.failures = 0, 0
+	c.Unlock()
+	c.checkBroken()
+	c.Lock()
+	c.heartbeat()
+	c.Unlock()
+	return c
+}
+
+// Checker sets the Checker used for heartbeats and immediately checks
+// the connection with it. Passing nil restores the default, which is
+// a HTTP GET request to the URL of the connection.
+func (c *HttpConnection) Checker(checker Checker) *HttpConnection {
+	c.Lock()
+	c.checker = checker
+	c.successes, c.failures = 0, 0
+	c.Unlock()
+	c.checkBroken()
+	c.Lock()
+	c.heartbeat()
+	c.Unlock()
 	return c
 }
 
-// heartbeat periodically checks if the connection is broken.
+// RiseFall sets the number of consecutive passed checks after which a
+// broken connection is considered healthy again (rise), and the number
+// of consecutive failed checks after which a healthy connection is
+// considered broken (fall). This prevents a single failed heartbeat from
+// taking a connection out of rotation. Both default to 1. The very first
+// check of a connection determines its state regardless of these values.
+func (c *HttpConnection) RiseFall(rise, fall int) *HttpConnection {
+	c.Lock()
+	defer c.Unlock()
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+	c.rise = rise
+	c.fall = fall
+	return c
+}
+
+// Logger sets the logger of the connection. It logs failed health checks
+// at debug level and changes between healthy and broken at info and
+// warn level. Passing nil disables logging, which is the default.
+func (c *HttpConnection) Logger(logger *slog.Logger) *HttpConnection {
+	c.Lock()
+	defer c.Unlock()
+	c.logger = logger
+	return c
+}
+
+// defaultChecker is used by connections without a Checker. It is shared
+// so that heartbeats of connections to the same URL can be deduplicated.
+var defaultChecker = &HealthCheck{}
+
+// heartbeat (re-)registers the periodic check of the connection with
+// its scheduler, unless the connection has been closed.
+// The caller must hold the lock.
 func (c *HttpConnection) heartbeat() {
-	ticker := time.NewTicker(c.heartbeatDuration)
-	for {
-		select {
-		case <-ticker.C:
-			c.checkBroken()
-		case <-c.heartbeatStop:
+	if c.sub != nil {
+		c.scheduler.unsubscribe(c.sub)
+		c.sub = nil
+	}
+	if c.closed {
+		return
+	}
+	var sub *subscription
+	sub = c.scheduler.subscribe(c.url, c.getChecker(), c.transport, c.heartbeatDuration, func(err error) {
+		c.Lock()
+		if c.sub != sub {
+			c.Unlock()
 			return
 		}
+		ev := c.update(err)
+		logger, failures := c.logger, c.failures
+		c.Unlock()
+		c.log(logger, err, failures, ev)
+		c.notify(ev)
+	})
+	c.sub = sub
+}
+
+// getChecker returns the checker to use. The caller must hold the lock.
+func (c *HttpConnection) getChecker() Checker {
+	if c.checker == nil {
+		return defaultChecker
 	}
+	return c.checker
 }
 
 // checkBroken checks if the HTTP connection is alive.
 func (c *HttpConnection) checkBroken() {
 	c.Lock()
-	defer c.Unlock()
+	checker := withTransport(c.getChecker(), c.transport)
+	scheduler := c.scheduler
+	c.Unlock()
+
+	err := scheduler.check(c.url, checker)
+
+	c.Lock()
+	ev := c.update(err)
+	logger, failures := c.logger, c.failures
+	c.Unlock()
+	c.log(logger, err, failures, ev)
+	c.notify(ev)
+}
+
+// update records the result of a check and changes the state of the
+// connection according to the rise and fall thresholds. It returns
+// an event if the state has changed. The caller must hold the lock.
+func (c *HttpConnection) update(err error) *HealthEvent {
+	first := c.successes == 0 && c.failures == 0
+	c.lastCheck = c.scheduler.now()
+	c.lastErr = err
+	if err == nil {
+		c.successes++
+		c.failures = 0
+	} else {
+		c.failures++
+		c.successes = 0
+	}
+	switch {
+	case first && err != nil:
+		return c.setBroken(true, "initial check failed", err)
+	case first:
+		return c.setBroken(false, "initial check passed", nil)
+	case c.broken && c.successes >= c.rise:
+		return c.setBroken(false, fmt.Sprintf("%d consecutive checks passed", c.successes), nil)
+	case !c.broken && c.failures >= c.fall:
+		return c.setBroken(true, fmt.Sprintf("%d consecutive checks failed", c.failures), err)
+	}
+	return nil
+}
 
-	// TODO(oe) Can we use HEAD?
-	req, err := http.NewRequest("GET", c.url.String(), nil)
-	if err != nil {
-		c.broken = true
+// log logs the result of a check, the number of consecutive failures
+// after it, and the change of state it caused, if any. It must be called
+// without holding the lock.
+func (c *HttpConnection) log(logger *slog.Logger, err error, failures int, ev *HealthEvent) {
+	if logger == nil {
 		return
 	}
-	// Add UA to heartbeat requests.
-	req.Header.Add("User-Agent", UserAgent)
+	ctx := context.Background()
+	switch {
+	case ev != nil && ev.Broken:
+		attrs := append([]slog.Attr{backendAttr(c.url), slog.String("reason", ev.Reason)}, ErrorAttrs(err)...)
+		logger.LogAttrs(ctx, slog.LevelWarn, "backend is broken", attrs...)
+	case ev != nil:
+		logger.LogAttrs(ctx, slog.LevelInfo, "backend is healthy", backendAttr(c.url), slog.String("reason", ev.Reason))
+	case err != nil:
+		attrs := append([]slog.Attr{backendAttr(c.url), slog.Int("consecutive_failures", failures)}, ErrorAttrs(err)...)
+		logger.LogAttrs(ctx, slog.LevelDebug, "health check failed", attrs...)
+	}
+}
 
-	// Use a standard HTTP client with a timeout of 5 seconds.
-	cl := &http.Client{Timeout: 5 * time.Second}
-	res, err := cl.Do(req)
-	if err == nil {
-		defer res.Body.Close()
-		if res.StatusCode == http.StatusOK {
-			c.broken = false
-		} else {
-			c.broken = true
+// setBroken changes the state of the connection. It returns an event
+// if the state has changed, and queues it for notify. The caller must
+// hold the lock.
+func (c *HttpConnection) setBroken(broken bool, reason string, err error) *HealthEvent {
+	if c.broken == broken {
+		return nil
+	}
+	c.broken = broken
+	ev := newHealthEvent(c, c.scheduler.now(), broken, reason, err)
+	c.events = append(c.events, ev)
+	return &ev
+}
+
+// Subscribe registers fn to be called whenever the connection moves
+// between healthy and broken. Calling the returned function stops the
+// notifications. fn is called by one goroutine at a time, in the order in
+// which the state has changed, and must not block.
+func (c *HttpConnection) Subscribe(fn func(HealthEvent)) func() {
+	c.Lock()
+	defer c.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[uint64]func(HealthEvent))
+	}
+	c.nextSubscriber++
+	id := c.nextSubscriber
+	c.subscribers[id] = fn
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+		delete(c.subscribers, id)
+	}
+}
+
+// notify passes the queued events to all subscribers. Only one goroutine
+// at a time does so, so that the events are passed in the order in which
+// the state has changed, even if checks run concurrently. ev is the event
+// of the caller, if any; if another goroutine is passing events, it
+// passes ev as well. It must be called without holding the lock.
+func (c *HttpConnection) notify(ev *HealthEvent) {
+	if ev == nil {
+		return
+	}
+	c.Lock()
+	if c.reporting {
+		c.Unlock()
+		return
+	}
+	c.reporting = true
+	for len(c.events) > 0 {
+		ev := c.events[0]
+		c.events = c.events[1:]
+		fns := make([]func(HealthEvent), 0, len(c.subscribers))
+		for _, fn := range c.subscribers {
+			fns = append(fns, fn)
 		}
-	} else {
-		c.broken = true
+		c.Unlock()
+		for _, fn := range fns {
+			fn(ev)
+		}
+		c.Lock()
 	}
+	c.events = nil
+	c.reporting = false
+	c.Unlock()
 }
 
 // URL returns the URL of the HTTP connection.
@@ -112,5 +477,180 @@ func (c *HttpConnection) URL() *url.URL {
 
 // IsBroken returns true if the HTTP connection is currently broken.
 func (c *HttpConnection) IsBroken() bool {
+	c.Lock()
+	defer c.Unlock()
 	return c.broken
 }
+
+// State returns a snapshot of the health of the HTTP connection.
+func (c *HttpConnection) State() ConnectionState {
+	c.Lock()
+	defer c.Unlock()
+	return ConnectionState{
+		Broken:               c.broken,
+		ConsecutiveSuccesses: c.successes,
+		ConsecutiveFailures:  c.failures,
+		LastCheck:            c.lastCheck,
+		LastError:            c.lastErr,
+	}
+}
+
+// Drain stops the connection from receiving new requests, while requests
+// in flight complete normally. Use WaitIdle to wait for them, e.g. before
+// removing the connection from its balancer.
+func (c *HttpConnection) Drain() {
+	c.Lock()
+	defer c.Unlock()
+	c.draining = true
+}
+
+// Undrain makes a draining connection receive new requests again.
+func (c *HttpConnection) Undrain() {
+	c.Lock()
+	defer c.Unlock()
+	c.draining = false
+}
+
+// IsDraining returns true if the connection is draining.
+func (c *HttpConnection) IsDraining() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.draining
+}
+
+// Acquire registers a new request in flight.
+func (c *HttpConnection) Acquire() {
+	c.Lock()
+	defer c.Unlock()
+	if c.inflight == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.inflight++
+}
+
+// Release registers the completion of a request in flight.
+func (c *HttpConnection) Release() {
+	c.Lock()
+	defer c.Unlock()
+	if c.inflight == 0 {
+		return
+	}
+	c.inflight--
+	if c.inflight == 0 {
+		close(c.idle)
+	}
+}
+
+// InFlight returns the number of requests in flight.
+func (c *HttpConnection) InFlight() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.inflight
+}
+
+// RecordRequest records the result of a request for Stats.
+func (c *HttpConnection) RecordRequest(statusCode int, err error, elapsed time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.stats.record(statusCode, err, elapsed)
+}
+
+// Stats returns a snapshot of the state and the requests of the
+// HTTP connection.
+func (c *HttpConnection) Stats() ConnectionStats {
+	c.Lock()
+	stats := ConnectionStats{
+		URL:                  c.url.Redacted(),
+		Broken:               c.broken,
+		Draining:             c.draining,
+		Weight:               c.weight,
+		Priority:             c.priority,
+		ConsecutiveSuccesses: c.successes,
+		ConsecutiveFailures:  c.failures,
+		LastCheck:            c.lastCheck,
+		Requests:             c.stats.requests,
+		Errors:               c.stats.errors,
+		InFlight:             c.inflight,
+	}
+	if c.lastErr != nil {
+		stats.LastError = c.lastErr.Error()
+	}
+	latencies := c.stats.window()
+	c.Unlock()
+
+	stats.Latency = latencyOf(latencies)
+	return stats
+}
+
+// WaitIdle blocks until the connection has no requests in flight or
+// the context is done.
+func (c *HttpConnection) WaitIdle(ctx context.Context) error {
+	c.Lock()
+	if c.inflight == 0 {
+		c.Unlock()
+		return nil
+	}
+	idle := c.idle
+	c.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetWeight sets the relative weight of the connection. Values less
+// than 1 are treated as 1.
+func (c *HttpConnection) SetWeight(weight int) {
+	c.Lock()
+	defer c.Unlock()
+	if weight < 1 {
+		weight = 1
+	}
+	c.weight = weight
+}
+
+// Weight returns the relative weight of the connection.
+func (c *HttpConnection) Weight() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.weight
+}
+
+// SetPriority sets the priority of the connection. Lower values
+// take precedence.
+func (c *HttpConnection) SetPriority(priority int) {
+	c.Lock()
+	defer c.Unlock()
+	c.priority = priority
+}
+
+// Priority returns the priority of the connection.
+func (c *HttpConnection) Priority() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.priority
+}
+
+// SetLabels sets the labels of the connection.
+func (c *HttpConnection) SetLabels(labels map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+	c.labels = make(map[string]string, len(labels))
+	for k, v := range labels {
+		c.labels[k] = v
+	}
+}
+
+// Labels returns a copy of the labels of the connection.
+func (c *HttpConnection) Labels() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	labels := make(map[string]string, len(c.labels))
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+	return labels
+}
@@ -4,9 +4,13 @@
 package balancers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 )
@@ -99,3 +103,217 @@ func TestHttpConnectionHeartbeat(t *testing.T) {
 		t.Errorf("expected %d heartbeats; got: %d", 2, count)
 	}
 }
+
+func TestHttpConnectionWithHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url)
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+	conn.HealthCheck(&HealthCheck{Path: "/healthz"})
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+}
+
+func TestHttpConnectionWithOptions(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnectionWithOptions(url, HttpConnectionOptions{
+		Checker:           &HealthCheck{Path: "/healthz"},
+		HeartbeatDuration: time.Hour,
+		Rise:              2,
+		Fall:              3,
+	})
+	defer conn.Close()
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want, have := "map[/healthz:1]", fmt.Sprint(paths); want != have {
+		t.Errorf("expected requests %s; got: %s", want, have)
+	}
+	if conn.rise != 2 || conn.fall != 3 || conn.heartbeatDuration != time.Hour {
+		t.Errorf("expected rise 2, fall 3 and heartbeat 1h; got: %d, %d and %v", conn.rise, conn.fall, conn.heartbeatDuration)
+	}
+}
+
+func TestHttpConnectionRiseFall(t *testing.T) {
+	var fail bool
+	checker := CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		if fail {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	url, _ := url.Parse("http://localhost:12345")
+	conn := NewHttpConnection(url).RiseFall(2, 3).Checker(checker)
+	if conn.IsBroken() {
+		t.Fatal("expected connection to not be broken")
+	}
+
+	tests := []struct {
+		Fail      bool
+		Broken    bool
+		Successes int
+		Failures  int
+	}{
+		{true, false, 0, 1},
+		{true, false, 0, 2},
+		{false, false, 1, 0},
+		{true, false, 0, 1},
+		{true, false, 0, 2},
+		{true, true, 0, 3},
+		{false, true, 1, 0},
+		{true, true, 0, 1},
+		{false, true, 1, 0},
+		{false, false, 2, 0},
+	}
+	for i, test := range tests {
+		fail = test.Fail
+		conn.checkBroken()
+		state := conn.State()
+		if state.Broken != test.Broken {
+			t.Errorf("#%d: expected broken = %v; got: %v", i, test.Broken, state.Broken)
+		}
+		if state.ConsecutiveSuccesses != test.Successes {
+			t.Errorf("#%d: expected %d successes; got: %d", i, test.Successes, state.ConsecutiveSuccesses)
+		}
+		if state.ConsecutiveFailures != test.Failures {
+			t.Errorf("#%d: expected %d failures; got: %d", i, test.Failures, state.ConsecutiveFailures)
+		}
+		if test.Fail && state.LastError == nil {
+			t.Errorf("#%d: expected last error", i)
+		}
+		if state.LastCheck.IsZero() {
+			t.Errorf("#%d: expected time of last check", i)
+		}
+	}
+}
+
+func TestHttpConnectionHeartbeatDurationKeepsState(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	url, _ := url.Parse(down.URL)
+	conn := NewHttpConnection(url)
+	defer conn.Close()
+	if !conn.IsBroken() {
+		t.Fatal("expected connection to be broken")
+	}
+	conn.HeartbeatDuration(time.Hour)
+	if !conn.IsBroken() {
+		t.Error("expected connection to stay broken")
+	}
+}
+
+func TestHttpConnectionWithTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url).HealthCheck(&HealthCheck{Path: "/healthz"})
+	if !conn.IsBroken() {
+		t.Error("expected connection with unknown certificate to be broken")
+	}
+	conn.Transport(server.Client().Transport)
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+	conn.HealthCheck(&HealthCheck{Path: "/healthz", Transport: http.DefaultTransport})
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+}
+
+func TestHttpConnectionDrain(t *testing.T) {
+	url, _ := url.Parse("http://localhost:12345")
+	conn := NewHttpConnection(url)
+	defer conn.Close()
+
+	if conn.IsDraining() {
+		t.Fatal("expected connection to not be draining")
+	}
+	conn.Acquire()
+	conn.Acquire()
+	conn.Drain()
+	if !conn.IsDraining() {
+		t.Fatal("expected connection to be draining")
+	}
+	if conn.InFlight() != 2 {
+		t.Fatalf("expected %d requests in flight; got: %d", 2, conn.InFlight())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := conn.WaitIdle(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v; got: %v", context.DeadlineExceeded, err)
+	}
+
+	done := make(chan error)
+	go func() { done <- conn.WaitIdle(context.Background()) }()
+	conn.Release()
+	conn.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if conn.InFlight() != 0 {
+		t.Fatalf("expected %d requests in flight; got: %d", 0, conn.InFlight())
+	}
+
+	conn.Undrain()
+	if conn.IsDraining() {
+		t.Fatal("expected connection to not be draining")
+	}
+}
+
+func TestHttpConnectionWeightPriorityAndLabels(t *testing.T) {
+	url, _ := url.Parse("http://localhost:12345")
+	conn := NewHttpConnection(url)
+	defer conn.Close()
+
+	if conn.Weight() != 1 {
+		t.Errorf("expected weight %d; got: %d", 1, conn.Weight())
+	}
+	conn.SetWeight(3)
+	if conn.Weight() != 3 {
+		t.Errorf("expected weight %d; got: %d", 3, conn.Weight())
+	}
+	conn.SetWeight(0)
+	if conn.Weight() != 1 {
+		t.Errorf("expected weight %d; got: %d", 1, conn.Weight())
+	}
+
+	conn.SetPriority(10)
+	if conn.Priority() != 10 {
+		t.Errorf("expected priority %d; got: %d", 10, conn.Priority())
+	}
+
+	labels := map[string]string{"zone": "eu-1"}
+	conn.SetLabels(labels)
+	labels["zone"] = "us-1"
+	if zone := conn.Labels()["zone"]; zone != "eu-1" {
+		t.Errorf("expected zone %q; got: %q", "eu-1", zone)
+	}
+}
@@ -19,4 +19,15 @@ var (
 
 	// DefaultHeartbeatDuration is the default time between heartbeat messages.
 	DefaultHeartbeatDuration = 30 * time.Second
+
+	// DefaultHeartbeatJitter is the default fraction by which heartbeat
+	// intervals are randomized.
+	DefaultHeartbeatJitter = 0.1
+
+	// DefaultSchedulerWorkers is the default number of health checks
+	// a Scheduler runs concurrently.
+	DefaultSchedulerWorkers = 16
+
+	// DefaultHealthCheckTimeout is the default time limit for a health check.
+	DefaultHealthCheckTimeout = 5 * time.Second
 )
@@ -0,0 +1,286 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// ConsulConfig configures a Consul source.
+type ConsulConfig struct {
+	// Address of the Consul agent. It defaults to "http://127.0.0.1:8500".
+	Address string
+
+	// Service is the name of the service.
+	Service string
+
+	// Tag, if set, only selects the instances with this tag.
+	Tag string
+
+	// Datacenter, if set, is the datacenter to query.
+	Datacenter string
+
+	// Token, if set, is the ACL token sent with every request.
+	Token string
+
+	// Scheme of the backends. It defaults to "http".
+	Scheme string
+
+	// Wait is the maximum time a blocking query waits for changes.
+	// It defaults to 5 minutes.
+	Wait time.Duration
+
+	// RetryInterval is the time to wait after a failed query.
+	// It defaults to 5 seconds.
+	RetryInterval time.Duration
+
+	// Client sends the requests to Consul. It defaults to a client whose
+	// timeout is long enough for blocking queries.
+	Client *http.Client
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when a query fails. The balancer
+	// keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "consul".
+	Logger *slog.Logger
+}
+
+// Consul is a source that keeps the connections of a balancer in sync
+// with the passing instances of a service registered in Consul. It uses
+// blocking queries of the health API, so changes are applied as soon as
+// Consul reports them.
+//
+// The weight of a backend is the passing weight of the service instance.
+// Its labels contain the service meta data, the tags of the instance as
+// "tag.<tag>" with an empty value, and the instance ID, node, and
+// datacenter as "service.id", "node", and "datacenter".
+//
+// A query without passing instances, e.g. while all instances fail their
+// checks at once, counts as failed, so the balancer keeps its connections
+// until Consul reports passing instances again.
+type Consul struct {
+	cfg    ConsulConfig
+	base   *url.URL
+	syncer *Syncer
+	poller *poller
+
+	mu      sync.Mutex // guards the following variables
+	index   uint64     // X-Consul-Index of the last response
+	lastErr error
+}
+
+// NewConsul creates a new Consul source for the given balancer. It
+// queries Consul immediately and returns an error if that fails.
+// Afterwards, it watches the service until closed.
+func NewConsul(updater balancers.Updater, cfg ConsulConfig) (*Consul, error) {
+	if cfg.Service == "" {
+		return nil, errors.New("discovery: missing Consul service name")
+	}
+	if cfg.Address == "" {
+		cfg.Address = "http://127.0.0.1:8500"
+	}
+	base, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.Wait <= 0 {
+		cfg.Wait = 5 * time.Minute
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+	if cfg.Client == nil {
+		// Consul adds up to wait/16 of jitter to blocking queries
+		cfg.Client = &http.Client{Timeout: cfg.Wait + cfg.Wait/16 + 10*time.Second}
+	}
+	c := &Consul{
+		cfg:    cfg,
+		base:   base,
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "consul")),
+	}
+	if err := c.query(context.Background()); err != nil {
+		return nil, err
+	}
+	c.poller = newPoller(cfg.Clock, 0, c.refresh)
+	return c, nil
+}
+
+// Close stops watching the service.
+func (c *Consul) Close() error {
+	return c.poller.Close()
+}
+
+// Err returns the error of the last query, if any.
+func (c *Consul) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// refresh runs a blocking query and returns the time until the next one.
+func (c *Consul) refresh(ctx context.Context) time.Duration {
+	err := c.query(ctx)
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			c.syncer.reportError(err, c.cfg.OnError)
+		}
+		return c.cfg.RetryInterval
+	}
+	return 0
+}
+
+// consulServiceEntry is an entry returned by the health API of Consul.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// query asks Consul for the passing instances of the service. It blocks
+// until they change, unless this is the first query.
+func (c *Consul) query(ctx context.Context) error {
+	c.mu.Lock()
+	index := c.index
+	c.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("passing", "1")
+	if c.cfg.Tag != "" {
+		params.Set("tag", c.cfg.Tag)
+	}
+	if c.cfg.Datacenter != "" {
+		params.Set("dc", c.cfg.Datacenter)
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", c.cfg.Wait/time.Millisecond))
+	}
+	ref := &url.URL{
+		Path:     "/v1/health/service/" + url.PathEscape(c.cfg.Service),
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest("GET", c.base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", balancers.UserAgent)
+	if c.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", c.cfg.Token)
+	}
+
+	res, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("discovery: querying Consul: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return fmt.Errorf("discovery: querying Consul: status code %d", res.StatusCode)
+	}
+
+	newIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("discovery: querying Consul: invalid X-Consul-Index %q", res.Header.Get("X-Consul-Index"))
+	}
+	if index > 0 && newIndex == index {
+		// Timed out without changes
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("discovery: querying Consul: %v", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("discovery: querying Consul: no passing instances of %q", c.cfg.Service)
+	}
+	c.syncer.Sync(c.backends(entries))
+
+	// Reset the index if it goes backwards, as recommended by Consul
+	if newIndex < index {
+		newIndex = 0
+	}
+	c.mu.Lock()
+	c.index = newIndex
+	c.mu.Unlock()
+	return nil
+}
+
+// backends converts the entries returned by Consul into backends.
+func (c *Consul) backends(entries []consulServiceEntry) []Backend {
+	backends := make([]Backend, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		labels := map[string]string{
+			"service.id": e.Service.ID,
+			"node":       e.Node.Node,
+			"datacenter": e.Node.Datacenter,
+		}
+		for k, v := range e.Service.Meta {
+			labels[k] = v
+		}
+		for _, tag := range e.Service.Tags {
+			labels["tag."+tag] = ""
+		}
+		backends = append(backends, Backend{
+			URL: &url.URL{
+				Scheme: c.cfg.Scheme,
+				Host:   net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+			},
+			Weight: e.Service.Weights.Passing,
+			Labels: labels,
+		})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].URL.String() < backends[j].URL.String()
+	})
+	return backends
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is a minimal implementation of the health API of Consul
+// that supports blocking queries.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	body    string
+	changed chan struct{}
+	queries []string
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, body: "[]", changed: make(chan struct{})}
+}
+
+func (c *fakeConsul) set(body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.body = body
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" || r.Header.Get("X-Consul-Token") != "secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	c.mu.Lock()
+	c.queries = append(c.queries, r.URL.RawQuery)
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+
+	if s := r.URL.Query().Get("index"); s != "" {
+		if want, _ := strconv.ParseUint(s, 10, 64); want >= index {
+			wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	fmt.Fprint(w, c.body)
+}
+
+// waitFor waits until cond returns true or fails the test.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsul(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set(`[
+		{"Node":{"Node":"n1","Address":"10.0.0.1","Datacenter":"dc1"},
+		 "Service":{"ID":"web-1","Port":8080,"Tags":["v1"],"Meta":{"version":"1.0"},"Weights":{"Passing":10}}},
+		{"Node":{"Node":"n2","Address":"10.0.0.2","Datacenter":"dc1"},
+		 "Service":{"ID":"web-2","Address":"10.0.1.2","Port":8080}}
+	]`)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	balancer := newTestBalancer(t)
+	source, err := NewConsul(balancer, ConsulConfig{
+		Address:       server.URL,
+		Service:       "web",
+		Tag:           "v1",
+		Token:         "secret",
+		Wait:          time.Second,
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://10.0.0.1:8080 http://10.0.1.2:8080]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	conn, _ := balancer.Get()
+	tc := conn.(*testConn)
+	if tc.weight != 10 {
+		t.Errorf("expected weight %d; got: %d", 10, tc.weight)
+	}
+	for k, v := range map[string]string{"service.id": "web-1", "node": "n1", "datacenter": "dc1", "version": "1.0", "tag.v1": ""} {
+		if have, ok := tc.labels[k]; !ok || have != v {
+			t.Errorf("expected label %s=%q; got: %q", k, v, have)
+		}
+	}
+
+	// The blocking query returns as soon as the service changes
+	consul.set(`[{"Node":{"Address":"10.0.0.3"},"Service":{"Port":8080}}]`)
+	waitFor(t, func() bool {
+		return fmt.Sprint(urlsOf(balancer)) == "[http://10.0.0.3:8080]"
+	})
+
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	if len(consul.queries) < 2 {
+		t.Fatalf("expected at least %d queries; got: %d", 2, len(consul.queries))
+	}
+	if want, have := "passing=1&tag=v1", consul.queries[0]; want != have {
+		t.Errorf("expected query %q; got: %q", want, have)
+	}
+	if want, have := "index=2&passing=1&tag=v1&wait=1000ms", consul.queries[1]; want != have {
+		t.Errorf("expected query %q; got: %q", want, have)
+	}
+}
+
+func TestConsulKeepsStateOnErrors(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set(`[{"Node":{"Address":"10.0.0.1"},"Service":{"Port":8080}}]`)
+	server := httptest.NewServer(consul)
+
+	balancer := newTestBalancer(t)
+	errs := make(chan error, 10)
+	source, err := NewConsul(balancer, ConsulConfig{
+		Address:       server.URL,
+		Service:       "web",
+		Token:         "secret",
+		Wait:          time.Second,
+		RetryInterval: 10 * time.Millisecond,
+		NewConnection: newTestConn,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// A service without passing instances keeps the connections
+	consul.set(`[]`)
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "no passing instances") {
+		t.Errorf("expected error for no passing instances; got: %v", err)
+	}
+	if want, have := "[http://10.0.0.1:8080]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	consul.set(`[{"Node":{"Address":"10.0.0.2"},"Service":{"Port":8080}}]`)
+	waitFor(t, func() bool {
+		return fmt.Sprint(urlsOf(balancer)) == "[http://10.0.0.2:8080]"
+	})
+
+	server.CloseClientConnections()
+	server.Close()
+	for len(errs) > 0 {
+		<-errs // no passing instances
+	}
+	<-errs
+	if want, have := "[http://10.0.0.2:8080]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	if source.Err() == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+/*
+Package discovery provides sources that keep the connections of a
+balancer in sync with the backends of a service.
+
+A source finds backends, e.g. by resolving a DNS name, and applies them
+to any balancer that implements balancers.Updater, like the one in the
+roundrobin package:
+
+	balancer, _ := roundrobin.NewBalancer()
+	source, err := discovery.NewDNS(balancer, discovery.DNSConfig{
+		URL: "http://search.default.svc:9200",
+	})
+	...
+	defer source.Close()
+	client := balancers.NewClient(balancer)
+
+Sources refresh periodically until they are closed. Closing a source does
+not close the balancer or its connections.
+*/
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// DefaultRefreshInterval is the default time between two refreshes
+// of a source.
+var DefaultRefreshInterval = 30 * time.Second
+
+// Backend is a host found by a discovery source.
+type Backend struct {
+	// URL of the backend.
+	URL *url.URL
+
+	// Weight is the relative weight of the backend. Zero means 1.
+	Weight int
+
+	// Priority of the backend. Lower values take precedence.
+	Priority int
+
+	// Labels of the backend, e.g. its zone.
+	Labels map[string]string
+
+	// Draining is true if the backend is about to go away and must not
+	// receive new requests.
+	Draining bool
+}
+
+// Syncer applies the backends found by a source to a balancer.
+// It creates a connection for every new backend, keeps the connections
+// of known backends, and removes the connections of backends that are
+// gone. Backends are identified by their URL.
+//
+// The weight, priority, and labels of a backend are applied to connections
+// that have SetWeight, SetPriority, and SetLabels methods, and draining
+// to connections with Drain and Undrain methods, like
+// balancers.HttpConnection. They are applied when the connection is
+// created, and afterwards only when the source reports a different value,
+// so that changes made by hand, e.g. draining a connection, are kept
+// across refreshes.
+type Syncer struct {
+	syncMu        sync.Mutex // serializes calls to Sync
+	mu            sync.Mutex // guards the following variables
+	updater       balancers.Updater
+	newConnection func(*url.URL) balancers.Connection
+	conns         map[string]balancers.Connection
+	backends      map[string]Backend // as last reported, by URL
+	logger        *slog.Logger
+}
+
+// NewSyncer creates a new Syncer for the given balancer. newConnection
+// creates the connection for a new backend. If it is nil,
+// balancers.NewHttpConnection is used. It is called concurrently for
+// the new backends of a Sync, so it must be safe for concurrent use; the
+// same applies to the NewConnection functions of all sources.
+func NewSyncer(updater balancers.Updater, newConnection func(*url.URL) balancers.Connection) *Syncer {
+	if newConnection == nil {
+		newConnection = func(u *url.URL) balancers.Connection {
+			return balancers.NewHttpConnection(u)
+		}
+	}
+	return &Syncer{
+		updater:       updater,
+		newConnection: newConnection,
+		conns:         make(map[string]balancers.Connection),
+		backends:      make(map[string]Backend),
+	}
+}
+
+// Logger sets the logger of the Syncer. It logs the backends that are
+// added and removed by Sync, and errors of the source, if it reports them.
+// Passing nil disables logging, which is the default.
+func (s *Syncer) Logger(logger *slog.Logger) *Syncer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+	return s
+}
+
+// Sync atomically replaces the connections of the balancer with
+// connections to the given backends. Connections to new backends are
+// created concurrently, so that their initial checks do not add up.
+func (s *Syncer) Sync(backends []Backend) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	current := s.conns
+	s.mu.Unlock()
+
+	// Create the connections to new backends without holding the lock
+	var fresh []Backend
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		key := b.URL.String()
+		if _, found := current[key]; !found && !seen[key] {
+			fresh = append(fresh, b)
+		}
+		seen[key] = true
+	}
+	created := make([]balancers.Connection, len(fresh))
+	var wg sync.WaitGroup
+	for i, b := range fresh {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			created[i] = s.newConnection(b.URL)
+			configure(created[i], b)
+		}(i, b)
+	}
+	wg.Wait()
+	createdByKey := make(map[string]balancers.Connection, len(fresh))
+	for i, b := range fresh {
+		createdByKey[b.URL.String()] = created[i]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make(map[string]balancers.Connection)
+	reported := make(map[string]Backend)
+	list := make([]balancers.Connection, 0, len(backends))
+	var added, removed []string
+	for _, b := range backends {
+		key := b.URL.String()
+		if _, found := conns[key]; found {
+			continue
+		}
+		conn, found := s.conns[key]
+		if found {
+			reconfigure(conn, s.backends[key], b)
+		} else {
+			conn = createdByKey[key]
+			added = append(added, b.URL.Redacted())
+		}
+		conns[key] = conn
+		reported[key] = b
+		list = append(list, conn)
+	}
+	for key, conn := range s.conns {
+		if _, found := conns[key]; !found {
+			removed = append(removed, conn.URL().Redacted())
+		}
+	}
+	s.conns, s.backends = conns, reported
+	s.updater.Replace(list...)
+
+	if s.logger != nil && (len(added) > 0 || len(removed) > 0) {
+		sort.Strings(removed)
+		s.logger.Info("backends updated", "added", added, "removed", removed, "total", len(list))
+	}
+}
+
+// reportError logs an error of the source that uses the Syncer and
+// passes it to onError, if set.
+func (s *Syncer) reportError(err error, onError func(error)) {
+	s.mu.Lock()
+	logger := s.logger
+	s.mu.Unlock()
+	if logger != nil {
+		logger.LogAttrs(context.Background(), slog.LevelWarn, "discovery failed", balancers.ErrorAttrs(err)...)
+	}
+	if onError != nil {
+		onError(err)
+	}
+}
+
+// sourceLogger returns logger with a "source" attribute, or nil if
+// logger is nil.
+func sourceLogger(logger *slog.Logger, source string) *slog.Logger {
+	if logger == nil {
+		return nil
+	}
+	return logger.With("source", source)
+}
+
+// configure applies the settings of b to conn.
+func configure(conn balancers.Connection, b Backend) {
+	if c, ok := conn.(interface{ SetWeight(int) }); ok {
+		c.SetWeight(weightOf(b))
+	}
+	if c, ok := conn.(interface{ SetPriority(int) }); ok {
+		c.SetPriority(b.Priority)
+	}
+	if c, ok := conn.(interface{ SetLabels(map[string]string) }); ok {
+		c.SetLabels(b.Labels)
+	}
+	if c, ok := conn.(interface{ Drain() }); ok && b.Draining {
+		c.Drain()
+	}
+}
+
+// reconfigure applies the settings of b to conn that differ from prev,
+// the settings reported before.
+func reconfigure(conn balancers.Connection, prev, b Backend) {
+	if c, ok := conn.(interface{ SetWeight(int) }); ok && weightOf(b) != weightOf(prev) {
+		c.SetWeight(weightOf(b))
+	}
+	if c, ok := conn.(interface{ SetPriority(int) }); ok && b.Priority != prev.Priority {
+		c.SetPriority(b.Priority)
+	}
+	if c, ok := conn.(interface{ SetLabels(map[string]string) }); ok && !maps.Equal(b.Labels, prev.Labels) {
+		c.SetLabels(b.Labels)
+	}
+	if c, ok := conn.(interface {
+		Drain()
+		Undrain()
+	}); ok && b.Draining != prev.Draining {
+		if b.Draining {
+			c.Drain()
+		} else {
+			c.Undrain()
+		}
+	}
+}
+
+// weightOf returns the weight of b, which is at least 1.
+func weightOf(b Backend) int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// poller calls a refresh function periodically until it is closed.
+type poller struct {
+	mu      sync.Mutex // guards the following variables
+	clock   balancers.Clock
+	timer   balancers.Timer
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	refresh func(ctx context.Context) time.Duration
+}
+
+// newPoller creates a poller that calls refresh, waits for the duration
+// returned by refresh, and repeats. The first call happens after delay.
+func newPoller(clock balancers.Clock, delay time.Duration, refresh func(ctx context.Context) time.Duration) *poller {
+	if clock == nil {
+		clock = balancers.RealClock
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &poller{
+		clock:   clock,
+		ctx:     ctx,
+		cancel:  cancel,
+		refresh: refresh,
+	}
+	p.mu.Lock()
+	p.scheduleLocked(delay)
+	p.mu.Unlock()
+	return p
+}
+
+// scheduleLocked arms the timer. The caller must hold the lock.
+func (p *poller) scheduleLocked(d time.Duration) {
+	p.wg.Add(1)
+	p.timer = p.clock.AfterFunc(d, p.run)
+}
+
+// run calls refresh and schedules the next call.
+func (p *poller) run() {
+	defer p.wg.Done()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	next := p.refresh(p.ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.scheduleLocked(next)
+	}
+}
+
+// Close stops the poller and waits for a running refresh to finish.
+func (p *poller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.cancel()
+	if p.timer != nil && p.timer.Stop() {
+		p.wg.Done()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return nil
+}
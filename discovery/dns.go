@@ -0,0 +1,201 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// Resolver looks up the IP addresses of a host. *net.Resolver
+// implements Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver is implemented by resolvers that report the TTL of the
+// records they find. The DNS source then re-resolves the host when the
+// TTL expires.
+type TTLResolver interface {
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// DNSConfig configures a DNS source.
+type DNSConfig struct {
+	// URL of the service, e.g. "http://search.default.svc:9200".
+	// Its host name is resolved to A and AAAA records. Every address
+	// results in a backend with the same URL, except for the host.
+	URL string
+
+	// Interval is the time between two resolutions. It defaults to
+	// DefaultRefreshInterval. If the Resolver implements TTLResolver,
+	// the TTL of the records is used instead, but never less than
+	// MinInterval.
+	Interval time.Duration
+
+	// MinInterval is the minimum time between two resolutions when
+	// using TTLs. It defaults to one second.
+	MinInterval time.Duration
+
+	// Resolver to use. It defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when a resolution fails. The balancer
+	// keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "dns".
+	Logger *slog.Logger
+}
+
+// DNS is a source that resolves a host name to all of its IP addresses
+// and keeps one connection per address.
+type DNS struct {
+	cfg    DNSConfig
+	url    *url.URL
+	syncer *Syncer
+	poller *poller
+
+	mu      sync.Mutex // guards the following variables
+	lastErr error
+}
+
+// NewDNS creates a new DNS source for the given balancer. It resolves
+// the host immediately and returns an error if that fails. Afterwards,
+// it re-resolves periodically until closed.
+func NewDNS(updater balancers.Updater, cfg DNSConfig) (*DNS, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("discovery: missing host in URL %q", cfg.URL)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRefreshInterval
+	}
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = time.Second
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	d := &DNS{
+		cfg:    cfg,
+		url:    u,
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "dns")),
+	}
+	next, err := d.resolve(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	d.poller = newPoller(cfg.Clock, next, d.refresh)
+	return d, nil
+}
+
+// Close stops the periodic resolution.
+func (d *DNS) Close() error {
+	return d.poller.Close()
+}
+
+// Err returns the error of the last resolution, if any.
+func (d *DNS) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErr
+}
+
+// refresh resolves the host and returns the time until the next refresh.
+func (d *DNS) refresh(ctx context.Context) time.Duration {
+	next, err := d.resolve(ctx)
+	d.mu.Lock()
+	d.lastErr = err
+	d.mu.Unlock()
+	if err != nil {
+		d.syncer.reportError(err, d.cfg.OnError)
+	}
+	return next
+}
+
+// resolve looks up the addresses of the host and applies them to the
+// balancer. It returns the time until the next resolution.
+func (d *DNS) resolve(ctx context.Context) (time.Duration, error) {
+	host := d.url.Hostname()
+	next := d.cfg.Interval
+
+	var (
+		addrs []net.IPAddr
+		err   error
+	)
+	if r, ok := d.cfg.Resolver.(TTLResolver); ok {
+		var ttl time.Duration
+		addrs, ttl, err = r.LookupIPAddrTTL(ctx, host)
+		if err == nil {
+			next = ttl
+			if next < d.cfg.MinInterval {
+				next = d.cfg.MinInterval
+			}
+		}
+	} else {
+		addrs, err = d.cfg.Resolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return d.cfg.Interval, fmt.Errorf("discovery: resolving %q: %v", host, err)
+	}
+	if len(addrs) == 0 {
+		return d.cfg.Interval, fmt.Errorf("discovery: resolving %q: %v", host, errNoAddresses)
+	}
+
+	hosts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		hosts = append(hosts, urlHost(addr, d.url.Port()))
+	}
+	sort.Strings(hosts)
+
+	backends := make([]Backend, 0, len(hosts))
+	for _, host := range hosts {
+		u := *d.url
+		u.Host = host
+		backends = append(backends, Backend{URL: &u})
+	}
+	d.syncer.Sync(backends)
+	return next, nil
+}
+
+// urlHost returns the host part of a URL for the given address and
+// optional port. The zone of an IPv6 address is kept unescaped, like
+// url.Parse returns it; url.URL.String escapes it as "%25".
+func urlHost(addr net.IPAddr, port string) string {
+	host := addr.IP.String()
+	if addr.Zone != "" {
+		host += "%" + addr.Zone
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return host
+}
+
+var errNoAddresses = errors.New("no addresses found")
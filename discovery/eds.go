@@ -0,0 +1,424 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// edsTypeURL is the type of the resources requested by an EDS source.
+const edsTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+// EDSConfig configures an EDS source.
+type EDSConfig struct {
+	// Server is the URL of the control plane, e.g. "http://xds:18000".
+	Server string
+
+	// Cluster is the name of the cluster whose load assignment to use.
+	Cluster string
+
+	// NodeID and NodeCluster identify the client to the control plane.
+	NodeID      string
+	NodeCluster string
+
+	// Scheme of the backends. It defaults to "http".
+	Scheme string
+
+	// Interval is the time between two requests. It defaults to
+	// DefaultRefreshInterval.
+	Interval time.Duration
+
+	// Client sends the requests to the control plane. It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when a request fails or the control
+	// plane sends an invalid load assignment. The balancer keeps its
+	// connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "eds".
+	Logger *slog.Logger
+}
+
+// EDS is a source that receives the endpoints of a cluster from a control
+// plane via the xDS Endpoint Discovery Service, like an Envoy sidecar.
+// It uses the REST-JSON variant of the protocol, i.e. it polls
+// /v3/discovery:endpoints, and acknowledges or rejects every response.
+//
+// Endpoints that are unhealthy or timed out are removed, draining
+// endpoints are drained, and all others are used. The priority of the
+// locality of an endpoint becomes the priority of its backend. The weight
+// of a backend combines the weights of its locality and the endpoint, so
+// that every locality receives its share of the requests, independent of
+// its number of endpoints. The labels of a backend contain the locality as
+// "region", "zone", and "subzone", and the host name of the endpoint as
+// "hostname".
+type EDS struct {
+	cfg    EDSConfig
+	url    string
+	syncer *Syncer
+	poller *poller
+
+	mu      sync.Mutex // guards the following variables
+	version string
+	nonce   string
+	nack    error
+	lastErr error
+}
+
+// NewEDS creates a new EDS source for the given balancer. It requests the
+// load assignment of the cluster immediately and returns an error if that
+// fails. Afterwards, it polls the control plane until closed.
+func NewEDS(updater balancers.Updater, cfg EDSConfig) (*EDS, error) {
+	if cfg.Cluster == "" {
+		return nil, errors.New("discovery: missing EDS cluster name")
+	}
+	base, err := url.Parse(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("discovery: invalid EDS server %q", cfg.Server)
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRefreshInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	e := &EDS{
+		cfg:    cfg,
+		url:    base.ResolveReference(&url.URL{Path: "/v3/discovery:endpoints"}).String(),
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "eds")),
+	}
+	if err := e.fetch(context.Background()); err != nil {
+		return nil, err
+	}
+	e.poller = newPoller(cfg.Clock, cfg.Interval, e.refresh)
+	return e, nil
+}
+
+// Close stops polling the control plane.
+func (e *EDS) Close() error {
+	return e.poller.Close()
+}
+
+// Err returns the error of the last request, if any.
+func (e *EDS) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastErr
+}
+
+// Version returns the version of the load assignment last applied.
+func (e *EDS) Version() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.version
+}
+
+// refresh polls the control plane and returns the time until the next poll.
+func (e *EDS) refresh(ctx context.Context) time.Duration {
+	err := e.fetch(ctx)
+	e.mu.Lock()
+	e.lastErr = err
+	e.mu.Unlock()
+	if err != nil && ctx.Err() == nil {
+		e.syncer.reportError(err, e.cfg.OnError)
+	}
+	return e.cfg.Interval
+}
+
+// edsRequest is a DiscoveryRequest in the proto3 JSON mapping.
+type edsRequest struct {
+	VersionInfo string `json:"versionInfo,omitempty"`
+	Node        struct {
+		ID            string `json:"id,omitempty"`
+		Cluster       string `json:"cluster,omitempty"`
+		UserAgentName string `json:"userAgentName"`
+	} `json:"node"`
+	ResourceNames []string `json:"resourceNames"`
+	TypeURL       string   `json:"typeUrl"`
+	ResponseNonce string   `json:"responseNonce,omitempty"`
+	ErrorDetail   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errorDetail,omitempty"`
+}
+
+// edsResponse is a DiscoveryResponse in the proto3 JSON mapping.
+type edsResponse struct {
+	VersionInfo string              `json:"versionInfo"`
+	Resources   []edsLoadAssignment `json:"resources"`
+	TypeURL     string              `json:"typeUrl"`
+	Nonce       string              `json:"nonce"`
+}
+
+// edsLoadAssignment is a ClusterLoadAssignment in the proto3 JSON mapping.
+type edsLoadAssignment struct {
+	Type        string `json:"@type"`
+	ClusterName string `json:"clusterName"`
+	Endpoints   []struct {
+		Locality struct {
+			Region  string `json:"region"`
+			Zone    string `json:"zone"`
+			SubZone string `json:"subZone"`
+		} `json:"locality"`
+		LbEndpoints []struct {
+			Endpoint struct {
+				Address struct {
+					SocketAddress *struct {
+						Address   string `json:"address"`
+						PortValue int    `json:"portValue"`
+					} `json:"socketAddress"`
+				} `json:"address"`
+				Hostname string `json:"hostname"`
+			} `json:"endpoint"`
+			HealthStatus        string `json:"healthStatus"`
+			LoadBalancingWeight *int   `json:"loadBalancingWeight"`
+		} `json:"lbEndpoints"`
+		LoadBalancingWeight *int `json:"loadBalancingWeight"`
+		Priority            int  `json:"priority"`
+	} `json:"endpoints"`
+}
+
+// fetch requests the load assignment of the cluster and applies it to
+// the balancer.
+func (e *EDS) fetch(ctx context.Context) error {
+	var dr edsRequest
+	dr.Node.ID = e.cfg.NodeID
+	dr.Node.Cluster = e.cfg.NodeCluster
+	dr.Node.UserAgentName = balancers.UserAgent
+	dr.ResourceNames = []string{e.cfg.Cluster}
+	dr.TypeURL = edsTypeURL
+	e.mu.Lock()
+	dr.VersionInfo = e.version
+	dr.ResponseNonce = e.nonce
+	if e.nack != nil {
+		// Reject the last response with INVALID_ARGUMENT
+		dr.ErrorDetail = &struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{Code: 3, Message: e.nack.Error()}
+	}
+	e.mu.Unlock()
+
+	body, err := json.Marshal(dr)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", balancers.UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("discovery: requesting endpoints: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return fmt.Errorf("discovery: requesting endpoints: status code %d", res.StatusCode)
+	}
+
+	var resp edsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("discovery: requesting endpoints: %v", err)
+	}
+	backends, err := e.backends(resp)
+
+	e.mu.Lock()
+	e.nonce = resp.Nonce
+	e.nack = err
+	if err == nil {
+		e.version = resp.VersionInfo
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.syncer.Sync(backends)
+	return nil
+}
+
+// backends converts the load assignment of the cluster in a response
+// into backends.
+func (e *EDS) backends(resp edsResponse) ([]Backend, error) {
+	if resp.TypeURL != edsTypeURL {
+		return nil, fmt.Errorf("discovery: invalid EDS response type %q", resp.TypeURL)
+	}
+	var cla *edsLoadAssignment
+	for i := range resp.Resources {
+		r := &resp.Resources[i]
+		if r.Type != "" && r.Type != edsTypeURL {
+			return nil, fmt.Errorf("discovery: invalid EDS resource type %q", r.Type)
+		}
+		if r.ClusterName == e.cfg.Cluster {
+			cla = r
+		}
+	}
+	if cla == nil {
+		return nil, fmt.Errorf("discovery: missing load assignment for cluster %q", e.cfg.Cluster)
+	}
+
+	// Localities are only weighted if any of them has a weight, as in Envoy
+	weighted := false
+	for _, l := range cla.Endpoints {
+		if l.LoadBalancingWeight != nil {
+			weighted = true
+		}
+	}
+
+	type locality struct {
+		backends []Backend
+		weight   int // weight of the locality
+		total    int // total weight of its serving endpoints
+	}
+	var localities []locality
+	for _, l := range cla.Endpoints {
+		if l.Priority < 0 {
+			return nil, fmt.Errorf("discovery: invalid priority %d in cluster %q", l.Priority, e.cfg.Cluster)
+		}
+		loc := locality{weight: 1}
+		if weighted {
+			if l.LoadBalancingWeight == nil || *l.LoadBalancingWeight <= 0 {
+				continue
+			}
+			loc.weight = *l.LoadBalancingWeight
+		}
+		for _, lb := range l.LbEndpoints {
+			sa := lb.Endpoint.Address.SocketAddress
+			if sa == nil || sa.Address == "" {
+				continue
+			}
+			if sa.PortValue <= 0 || sa.PortValue > 65535 {
+				return nil, fmt.Errorf("discovery: invalid port %d in cluster %q", sa.PortValue, e.cfg.Cluster)
+			}
+			draining := false
+			switch lb.HealthStatus {
+			case "", "UNKNOWN", "HEALTHY", "DEGRADED":
+			case "DRAINING":
+				draining = true
+			default:
+				continue
+			}
+			weight := 1
+			if lb.LoadBalancingWeight != nil {
+				if *lb.LoadBalancingWeight <= 0 {
+					return nil, fmt.Errorf("discovery: invalid weight %d in cluster %q", *lb.LoadBalancingWeight, e.cfg.Cluster)
+				}
+				weight = *lb.LoadBalancingWeight
+			}
+			if !draining {
+				loc.total += weight
+			}
+			labels := make(map[string]string)
+			for k, v := range map[string]string{
+				"region":   l.Locality.Region,
+				"zone":     l.Locality.Zone,
+				"subzone":  l.Locality.SubZone,
+				"hostname": lb.Endpoint.Hostname,
+			} {
+				if v != "" {
+					labels[k] = v
+				}
+			}
+			loc.backends = append(loc.backends, Backend{
+				URL: &url.URL{
+					Scheme: e.cfg.Scheme,
+					Host:   net.JoinHostPort(sa.Address, strconv.Itoa(sa.PortValue)),
+				},
+				Weight:   weight,
+				Priority: l.Priority,
+				Labels:   labels,
+				Draining: draining,
+			})
+		}
+		localities = append(localities, loc)
+	}
+
+	// With weighted localities, the share of an endpoint is the share of
+	// its locality times its share within the locality. Scale the shares
+	// to integers by a fixed factor, so that the weights cannot overflow
+	// however many localities there are.
+	sum := 0
+	for _, loc := range localities {
+		sum += loc.weight
+	}
+	var backends []Backend
+	for _, loc := range localities {
+		for _, b := range loc.backends {
+			if weighted && loc.total > 0 {
+				share := float64(loc.weight) / float64(sum) * float64(b.Weight) / float64(loc.total)
+				b.Weight = int(math.Min(math.Round(share*edsWeightScale), edsWeightScale))
+				if b.Weight < 1 {
+					b.Weight = 1
+				}
+			}
+			backends = append(backends, b)
+		}
+	}
+
+	// Use the smallest weights with the same ratios
+	d := 0
+	for _, b := range backends {
+		d = gcd(d, b.Weight)
+	}
+	for i := range backends {
+		backends[i].Weight /= d
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].URL.String() < backends[j].URL.String()
+	})
+	return backends, nil
+}
+
+// edsWeightScale is the weight of an endpoint that receives all requests
+// of weighted localities.
+const edsWeightScale = 1e6
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/clocktest"
+)
+
+// fakeControlPlane is a minimal xDS server for the REST-JSON variant
+// of EDS.
+type fakeControlPlane struct {
+	mu        sync.Mutex
+	version   int
+	resources string
+	requests  []edsRequest
+}
+
+func (cp *fakeControlPlane) set(resources string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.version++
+	cp.resources = resources
+}
+
+func (cp *fakeControlPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/v3/discovery:endpoints" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var req edsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.requests = append(cp.requests, req)
+	version := strconv.Itoa(cp.version)
+	if req.VersionInfo == version && req.ErrorDetail == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprintf(w, `{"versionInfo":%q,"typeUrl":%q,"nonce":"n%s","resources":[%s]}`,
+		version, edsTypeURL, version, cp.resources)
+}
+
+func (cp *fakeControlPlane) lastRequest() edsRequest {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.requests[len(cp.requests)-1]
+}
+
+func TestEDS(t *testing.T) {
+	cp := &fakeControlPlane{}
+	cp.set(`{
+		"@type":"type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment",
+		"clusterName":"web",
+		"endpoints":[
+			{"locality":{"region":"eu","zone":"eu-1a"},"loadBalancingWeight":3,"lbEndpoints":[
+				{"endpoint":{"address":{"socketAddress":{"address":"10.0.0.1","portValue":8080}},"hostname":"web-1"},"healthStatus":"HEALTHY"},
+				{"endpoint":{"address":{"socketAddress":{"address":"10.0.0.2","portValue":8080}}},"healthStatus":"HEALTHY","loadBalancingWeight":2},
+				{"endpoint":{"address":{"socketAddress":{"address":"10.0.0.3","portValue":8080}}},"healthStatus":"DRAINING"},
+				{"endpoint":{"address":{"socketAddress":{"address":"10.0.0.4","portValue":8080}}},"healthStatus":"UNHEALTHY"}
+			]},
+			{"locality":{"region":"eu","zone":"eu-1b"},"loadBalancingWeight":1,"lbEndpoints":[
+				{"endpoint":{"address":{"socketAddress":{"address":"10.0.1.1","portValue":8080}}}}
+			]},
+			{"locality":{"region":"us"},"loadBalancingWeight":1,"priority":1,"lbEndpoints":[
+				{"endpoint":{"address":{"socketAddress":{"address":"10.1.0.1","portValue":8080}}}}
+			]}
+		]
+	}`)
+	server := httptest.NewServer(cp)
+	defer server.Close()
+
+	clock := clocktest.NewClock(time.Now())
+	var mu sync.Mutex
+	conns := make(map[string]*testConn)
+	balancer := newTestBalancer(t)
+	source, err := NewEDS(balancer, EDSConfig{
+		Server:   server.URL,
+		Cluster:  "web",
+		NodeID:   "client-1",
+		Interval: time.Minute,
+		Clock:    clock,
+		NewConnection: func(u *url.URL) balancers.Connection {
+			mu.Lock()
+			defer mu.Unlock()
+			conn := newTestConn(u).(*testConn)
+			conns[u.Host] = conn
+			return conn
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://10.0.0.1:8080 http://10.0.0.2:8080 http://10.0.0.3:8080 http://10.0.1.1:8080 http://10.1.0.1:8080]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	// eu-1a gets 3/4 of the requests, split 1:2, and eu-1b gets 1/4
+	for host, want := range map[string]struct {
+		weight, priority int
+		draining         bool
+	}{
+		"10.0.0.1:8080": {1, 0, false},
+		"10.0.0.2:8080": {2, 0, false},
+		"10.0.0.3:8080": {1, 0, true},
+		"10.0.1.1:8080": {1, 0, false},
+		"10.1.0.1:8080": {1, 1, false},
+	} {
+		conn := conns[host]
+		if conn.weight != want.weight {
+			t.Errorf("expected weight of %s to be %d; got: %d", host, want.weight, conn.weight)
+		}
+		if conn.priority != want.priority {
+			t.Errorf("expected priority of %s to be %d; got: %d", host, want.priority, conn.priority)
+		}
+		if conn.draining != want.draining {
+			t.Errorf("expected draining of %s to be %v; got: %v", host, want.draining, conn.draining)
+		}
+	}
+	for k, v := range map[string]string{"region": "eu", "zone": "eu-1a", "hostname": "web-1"} {
+		if have := conns["10.0.0.1:8080"].labels[k]; have != v {
+			t.Errorf("expected label %s=%q; got: %q", k, v, have)
+		}
+	}
+	req := cp.lastRequest()
+	if req.Node.ID != "client-1" || req.TypeURL != edsTypeURL || fmt.Sprint(req.ResourceNames) != "[web]" || req.VersionInfo != "" {
+		t.Errorf("unexpected initial request %+v", req)
+	}
+
+	// Unchanged versions are acknowledged and keep the balancer as is
+	clock.Advance(time.Minute)
+	waitFor(t, func() bool { return cp.lastRequest().ResponseNonce == "n1" })
+	if want, have := "1", source.Version(); want != have {
+		t.Errorf("expected version %q; got: %q", want, have)
+	}
+
+	// Invalid responses are rejected and keep the balancer as is
+	cp.set(`{"clusterName":"web","endpoints":[{"lbEndpoints":[{"endpoint":{"address":{"socketAddress":{"address":"10.2.0.1","portValue":0}}}}]}]}`)
+	clock.Advance(time.Minute)
+	waitFor(t, func() bool { return source.Err() != nil })
+	clock.Advance(time.Minute)
+	waitFor(t, func() bool { return cp.lastRequest().ErrorDetail != nil })
+	if req := cp.lastRequest(); req.VersionInfo != "1" || req.ResponseNonce != "n2" {
+		t.Errorf("expected NACK of version 2 at version 1; got: %+v", req)
+	}
+	if want, have := 5, len(urlsOf(balancer)); want != have {
+		t.Errorf("expected %d connections; got: %d", want, have)
+	}
+
+	// New versions are applied
+	cp.set(`{"clusterName":"web","endpoints":[{"lbEndpoints":[{"endpoint":{"address":{"socketAddress":{"address":"10.2.0.1","portValue":8080}}}}]}]}`)
+	clock.Advance(time.Minute)
+	waitFor(t, func() bool {
+		return fmt.Sprint(urlsOf(balancer)) == "[http://10.2.0.1:8080]"
+	})
+	if want, have := "3", source.Version(); want != have {
+		t.Errorf("expected version %q; got: %q", want, have)
+	}
+}
+
+func TestEDSWithManyLocalities(t *testing.T) {
+	// Localities with coprime totals used to overflow the weights
+	primes := []int{101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151}
+	var localities []string
+	for i, p := range primes {
+		localities = append(localities, fmt.Sprintf(`{"loadBalancingWeight":%d,"lbEndpoints":[
+			{"endpoint":{"address":{"socketAddress":{"address":"10.0.%d.1","portValue":8080}}},"loadBalancingWeight":1},
+			{"endpoint":{"address":{"socketAddress":{"address":"10.0.%d.2","portValue":8080}}},"loadBalancingWeight":%d}
+		]}`, i+1, i, i, p-1))
+	}
+	var resp edsResponse
+	doc := fmt.Sprintf(`{"typeUrl":%q,"resources":[{"clusterName":"web","endpoints":[%s]}]}`, edsTypeURL, strings.Join(localities, ","))
+	if err := json.Unmarshal([]byte(doc), &resp); err != nil {
+		t.Fatal(err)
+	}
+	e := &EDS{cfg: EDSConfig{Cluster: "web", Scheme: "http"}}
+	backends, err := e.backends(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2*len(primes), len(backends); want != have {
+		t.Fatalf("expected %d backends; got: %d", want, have)
+	}
+
+	total := 0
+	weights := make(map[string]int)
+	for _, b := range backends {
+		if b.Weight < 1 || b.Weight > edsWeightScale {
+			t.Errorf("expected weight of %s between 1 and %v; got: %d", b.URL.Host, edsWeightScale, b.Weight)
+		}
+		total += b.Weight
+		weights[b.URL.Host] = b.Weight
+	}
+	sum := len(primes) * (len(primes) + 1) / 2
+	for i, p := range primes {
+		for j, w := range []int{1, p - 1} {
+			host := fmt.Sprintf("10.0.%d.%d:8080", i, j+1)
+			want := float64(i+1) / float64(sum) * float64(w) / float64(p)
+			have := float64(weights[host]) / float64(total)
+			if math.Abs(want-have) > 1e-5 {
+				t.Errorf("expected share of %s to be %.6f; got: %.6f", host, want, have)
+			}
+		}
+	}
+}
+
+func TestEDSErrors(t *testing.T) {
+	cp := &fakeControlPlane{}
+	cp.set(`{"clusterName":"other"}`)
+	server := httptest.NewServer(cp)
+	defer server.Close()
+
+	if _, err := NewEDS(newTestBalancer(t), EDSConfig{Server: server.URL}); err == nil {
+		t.Error("expected error without cluster")
+	}
+	if _, err := NewEDS(newTestBalancer(t), EDSConfig{Server: "xds:18000", Cluster: "web"}); err == nil {
+		t.Error("expected error for invalid server")
+	}
+	if _, err := NewEDS(newTestBalancer(t), EDSConfig{Server: server.URL, Cluster: "web"}); err == nil {
+		t.Error("expected error for missing cluster in response")
+	}
+}
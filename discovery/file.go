@@ -0,0 +1,211 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// DefaultFileInterval is the default time between two checks of a file
+// for changes.
+var DefaultFileInterval = 5 * time.Second
+
+// FileConfig configures a File source.
+type FileConfig struct {
+	// Path of the file with the list of backends.
+	Path string
+
+	// Unmarshal decodes the file. It defaults to decoding JSON. Pass e.g.
+	// yaml.Unmarshal of gopkg.in/yaml.v3 to read YAML files. Unknown
+	// fields are rejected in any case, so Unmarshal must be able to decode
+	// into an interface{} with maps that have string keys, which are then
+	// checked like JSON.
+	Unmarshal func(data []byte, v interface{}) error
+
+	// Interval is the time between two checks of the file for changes.
+	// It defaults to DefaultFileInterval.
+	Interval time.Duration
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when the file cannot be read or is
+	// invalid. The balancer keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "file".
+	Logger *slog.Logger
+}
+
+// FileBackends is the content of a file read by a File source, e.g.:
+//
+//	{
+//	  "backends": [
+//	    {"url": "http://10.0.0.1:9200", "weight": 2, "labels": {"zone": "eu-1"}},
+//	    {"url": "http://10.0.0.2:9200"}
+//	  ]
+//	}
+type FileBackends struct {
+	Backends []FileBackend `json:"backends" yaml:"backends"`
+}
+
+// FileBackend is a single backend in a file read by a File source.
+type FileBackend struct {
+	URL      string            `json:"url" yaml:"url"`
+	Weight   int               `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Priority int               `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// File is a source that reads the list of backends from a file and
+// reloads it when it changes. If the file cannot be read or is invalid,
+// e.g. while it is being edited, the change is rejected and the balancer
+// keeps the last good list of backends.
+type File struct {
+	cfg    FileConfig
+	syncer *Syncer
+	poller *poller
+
+	mu      sync.Mutex // guards the following variables
+	last    []byte     // content of the file that was applied last
+	lastErr error
+}
+
+// NewFile creates a new File source for the given balancer. It reads the
+// file immediately and returns an error if it is invalid. Afterwards, it
+// checks the file for changes periodically until closed.
+func NewFile(updater balancers.Updater, cfg FileConfig) (*File, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("discovery: missing file path")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultFileInterval
+	}
+	f := &File{
+		cfg:    cfg,
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "file")),
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.poller = newPoller(cfg.Clock, cfg.Interval, f.refresh)
+	return f, nil
+}
+
+// Close stops checking the file for changes.
+func (f *File) Close() error {
+	return f.poller.Close()
+}
+
+// Err returns the error of the last check, if any.
+func (f *File) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastErr
+}
+
+// refresh checks the file and returns the time until the next check.
+func (f *File) refresh(ctx context.Context) time.Duration {
+	err := f.load()
+	f.mu.Lock()
+	f.lastErr = err
+	f.mu.Unlock()
+	if err != nil {
+		f.syncer.reportError(err, f.cfg.OnError)
+	}
+	return f.cfg.Interval
+}
+
+// load reads the file and applies it to the balancer if it has changed.
+func (f *File) load() error {
+	data, err := ioutil.ReadFile(f.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("discovery: %v", err)
+	}
+
+	f.mu.Lock()
+	unchanged := f.last != nil && bytes.Equal(data, f.last)
+	f.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	backends, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("discovery: invalid file %s: %v", f.cfg.Path, err)
+	}
+	f.syncer.Sync(backends)
+
+	f.mu.Lock()
+	f.last = data
+	f.mu.Unlock()
+	return nil
+}
+
+// parse decodes and validates the content of the file.
+func (f *File) parse(data []byte) ([]Backend, error) {
+	var doc FileBackends
+	if err := DecodeStrict(f.cfg.Unmarshal, data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	backends := make([]Backend, 0, len(doc.Backends))
+	for i, b := range doc.Backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, fmt.Errorf("backends[%d]: %v", i, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("backends[%d]: URL %q must have a scheme and a host", i, b.URL)
+		}
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("backends[%d]: weight must not be negative", i)
+		}
+		backends = append(backends, Backend{
+			URL:      u,
+			Weight:   b.Weight,
+			Priority: b.Priority,
+			Labels:   b.Labels,
+		})
+	}
+	return backends, nil
+}
+
+// DecodeStrict decodes data into v with unmarshal, or as JSON if unmarshal
+// is nil, and rejects fields that v does not have. Functions like
+// yaml.Unmarshal cannot reject them by themselves, so their result is
+// decoded into an interface{}, encoded as JSON, and decoded again.
+func DecodeStrict(unmarshal func(data []byte, v interface{}) error, data []byte, v interface{}) error {
+	if unmarshal != nil {
+		var doc interface{}
+		if err := unmarshal(data, &doc); err != nil {
+			return err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
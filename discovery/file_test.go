@@ -0,0 +1,167 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/clocktest"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "balancers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.json")
+
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"backends":[
+		{"url":"http://10.0.0.1:9200","weight":2,"labels":{"zone":"eu-1"}},
+		{"url":"http://10.0.0.2:9200"}
+	]}`)
+
+	clock := clocktest.NewClock(time.Now())
+	balancer := newTestBalancer(t)
+	var errs []error
+	source, err := NewFile(balancer, FileConfig{
+		Path:          path,
+		Interval:      time.Second,
+		Clock:         clock,
+		NewConnection: newTestConn,
+		OnError:       func(err error) { errs = append(errs, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://10.0.0.1:9200 http://10.0.0.2:9200]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	conn, _ := balancer.Get()
+	if w := conn.(balancers.Weighted).Weight(); w != 2 {
+		t.Errorf("expected weight %d; got: %d", 2, w)
+	}
+	if zone := conn.(*testConn).labels["zone"]; zone != "eu-1" {
+		t.Errorf("expected zone %q; got: %q", "eu-1", zone)
+	}
+
+	// Reload
+	write(`{"backends":[{"url":"http://10.0.0.2:9200"},{"url":"http://10.0.0.3:9200"}]}`)
+	clock.Advance(time.Second)
+	if want, have := "[http://10.0.0.2:9200 http://10.0.0.3:9200]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	// Invalid edits are rejected
+	tests := []struct {
+		Content string
+		Error   string
+	}{
+		{`{"backends":[{"url":"http://10.0.0.4:9200"}`, "unexpected EOF"},
+		{`{"backends":[]}`, "no backends"},
+		{`{"backends":[{"url":"10.0.0.4"}]}`, "backends[0]: URL \"10.0.0.4\" must have a scheme and a host"},
+		{`{"backends":[{"url":"http://10.0.0.4"},{"url":"http://10.0.0.5","weight":-1}]}`, "backends[1]: weight must not be negative"},
+	}
+	for i, test := range tests {
+		write(test.Content)
+		clock.Advance(time.Second)
+		if want, have := "[http://10.0.0.2:9200 http://10.0.0.3:9200]", fmt.Sprint(urlsOf(balancer)); want != have {
+			t.Fatalf("#%d: expected %s; got: %s", i, want, have)
+		}
+		if err := source.Err(); err == nil || !strings.Contains(err.Error(), test.Error) {
+			t.Errorf("#%d: expected error %q; got: %v", i, test.Error, err)
+		}
+	}
+	if len(errs) != len(tests) {
+		t.Errorf("expected %d errors; got: %d", len(tests), len(errs))
+	}
+
+	// Removing the file keeps the last good state, too
+	os.Remove(path)
+	clock.Advance(time.Second)
+	if want, have := "[http://10.0.0.2:9200 http://10.0.0.3:9200]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	if source.Err() == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFileWithCustomUnmarshal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "balancers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.txt")
+	if err := ioutil.WriteFile(path, []byte("http://10.0.0.1\nhttp://10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line-based format
+	unmarshal := func(data []byte, v interface{}) error {
+		var backends []interface{}
+		for _, line := range strings.Fields(string(data)) {
+			backends = append(backends, map[string]interface{}{"url": line})
+		}
+		*v.(*interface{}) = map[string]interface{}{"backends": backends}
+		return nil
+	}
+
+	balancer := newTestBalancer(t)
+	source, err := NewFile(balancer, FileConfig{
+		Path:          path,
+		Unmarshal:     unmarshal,
+		Clock:         clocktest.NewClock(time.Now()),
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://10.0.0.1 http://10.0.0.2]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+}
+
+func TestFileRejectsUnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "balancers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.json")
+	if err := ioutil.WriteFile(path, []byte(`{"backends": [{"url": "http://10.0.0.1", "wieght": 2}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// json.Unmarshal accepts unknown fields, like yaml.Unmarshal
+	for _, unmarshal := range []func([]byte, interface{}) error{nil, json.Unmarshal} {
+		_, err := NewFile(newTestBalancer(t), FileConfig{
+			Path:          path,
+			Unmarshal:     unmarshal,
+			Clock:         clocktest.NewClock(time.Now()),
+			NewConnection: newTestConn,
+		})
+		if err == nil || !strings.Contains(err.Error(), `unknown field "wieght"`) {
+			t.Errorf("expected unknown field error; got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+const (
+	// kubernetesServiceAccountDir is where Kubernetes mounts the
+	// credentials of the service account into a pod.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// KubernetesConfig configures a Kubernetes source.
+type KubernetesConfig struct {
+	// APIServer is the URL of the Kubernetes API server. It defaults to
+	// the in-cluster address from the KUBERNETES_SERVICE_HOST and
+	// KUBERNETES_SERVICE_PORT environment variables.
+	APIServer string
+
+	// Namespace of the service. It defaults to the namespace of the pod
+	// or "default".
+	Namespace string
+
+	// Service is the name of the service.
+	Service string
+
+	// Port is the name of the port of the service to use. It defaults
+	// to the first port.
+	Port string
+
+	// Scheme of the backends. It defaults to "http".
+	Scheme string
+
+	// Token is the bearer token to authenticate with. If empty, the
+	// token of the service account of the pod is used, if any.
+	Token string
+
+	// Client sends the requests to the API server. It defaults to a
+	// client that trusts the CA of the service account of the pod.
+	Client *http.Client
+
+	// RetryInterval is the time to wait after a failed request.
+	// It defaults to 5 seconds.
+	RetryInterval time.Duration
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when a request fails. The balancer
+	// keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "kubernetes".
+	Logger *slog.Logger
+}
+
+// Kubernetes is a source that watches the EndpointSlices of a Kubernetes
+// service and keeps the connections of a balancer in sync with its ready
+// endpoints. This allows clients in the cluster to balance requests
+// without kube-proxy.
+//
+// Endpoints that are terminating but still serving are drained. The labels
+// of a backend contain the zone, node, and pod of the endpoint as "zone",
+// "node", and "pod", and the zones it should be consumed from as
+// "hints.zones", separated by commas.
+type Kubernetes struct {
+	cfg    KubernetesConfig
+	base   *url.URL
+	syncer *Syncer
+	poller *poller
+
+	mu              sync.Mutex // guards the following variables
+	slices          map[string]endpointSlice
+	resourceVersion string
+	lastErr         error
+}
+
+// NewKubernetes creates a new Kubernetes source for the given balancer.
+// It lists the EndpointSlices of the service immediately and returns an
+// error if that fails. Afterwards, it watches them until closed.
+func NewKubernetes(updater balancers.Updater, cfg KubernetesConfig) (*Kubernetes, error) {
+	if cfg.Service == "" {
+		return nil, errors.New("discovery: missing Kubernetes service name")
+	}
+	if cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("discovery: missing Kubernetes API server")
+		}
+		cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	base, err := url.Parse(cfg.APIServer)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+		if data, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace"); err == nil {
+			cfg.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client, err = inClusterClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	k := &Kubernetes{
+		cfg:    cfg,
+		base:   base,
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "kubernetes")),
+	}
+	if err := k.list(context.Background()); err != nil {
+		return nil, err
+	}
+	k.poller = newPoller(cfg.Clock, 0, k.refresh)
+	return k, nil
+}
+
+// inClusterClient returns a HTTP client that trusts the CA of the service
+// account of the pod, if there is one.
+func inClusterClient() (*http.Client, error) {
+	pem, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if os.IsNotExist(err) {
+		return &http.Client{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("discovery: invalid Kubernetes CA certificate")
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+// Close stops watching the service.
+func (k *Kubernetes) Close() error {
+	return k.poller.Close()
+}
+
+// Err returns the error of the last request, if any.
+func (k *Kubernetes) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lastErr
+}
+
+// refresh watches the EndpointSlices until the watch ends, and returns
+// the time until the next watch.
+func (k *Kubernetes) refresh(ctx context.Context) time.Duration {
+	k.mu.Lock()
+	relist := k.resourceVersion == ""
+	k.mu.Unlock()
+
+	var err error
+	if relist {
+		err = k.list(ctx)
+	}
+	if err == nil {
+		err = k.watch(ctx)
+	}
+	k.mu.Lock()
+	k.lastErr = err
+	k.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			k.syncer.reportError(err, k.cfg.OnError)
+		}
+		return k.cfg.RetryInterval
+	}
+	return 0
+}
+
+// endpointSlice is a discovery.k8s.io/v1 EndpointSlice.
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName  string `json:"nodeName"`
+		Zone      string `json:"zone"`
+		TargetRef *struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+		Hints *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+// request sends a GET request for the EndpointSlices of the service.
+func (k *Kubernetes) request(ctx context.Context, params url.Values) (*http.Response, error) {
+	params.Set("labelSelector", "kubernetes.io/service-name="+k.cfg.Service)
+	ref := &url.URL{
+		Path:     "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(k.cfg.Namespace) + "/endpointslices",
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest("GET", k.base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", balancers.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	token := k.cfg.Token
+	if token == "" {
+		// Read the token every time as Kubernetes rotates it
+		if data, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/token"); err == nil {
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := k.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: requesting EndpointSlices: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("discovery: requesting EndpointSlices: status code %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+// list fetches all EndpointSlices of the service and applies them.
+func (k *Kubernetes) list(ctx context.Context) error {
+	res, err := k.request(ctx, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return fmt.Errorf("discovery: decoding EndpointSlices: %v", err)
+	}
+
+	slices := make(map[string]endpointSlice)
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	k.mu.Lock()
+	k.slices = slices
+	k.resourceVersion = list.Metadata.ResourceVersion
+	k.mu.Unlock()
+	k.sync()
+	return nil
+}
+
+// watch applies the changes of the EndpointSlices of the service until
+// the API server ends the watch.
+func (k *Kubernetes) watch(ctx context.Context) error {
+	k.mu.Lock()
+	rv := k.resourceVersion
+	k.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("watch", "1")
+	params.Set("allowWatchBookmarks", "true")
+	params.Set("resourceVersion", rv)
+	res, err := k.request(ctx, params)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("discovery: decoding watch event: %v", err)
+		}
+
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				// The resource version is too old: list again
+				k.mu.Lock()
+				k.resourceVersion = ""
+				k.mu.Unlock()
+				return nil
+			}
+			return fmt.Errorf("discovery: watch failed: %s", status.Message)
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return fmt.Errorf("discovery: decoding EndpointSlice: %v", err)
+		}
+		k.mu.Lock()
+		k.resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(k.slices, slice.Metadata.Name)
+		}
+		k.mu.Unlock()
+		if event.Type != "BOOKMARK" {
+			k.sync()
+		}
+	}
+}
+
+// sync applies the current EndpointSlices to the balancer.
+func (k *Kubernetes) sync() {
+	k.mu.Lock()
+	slices := make([]endpointSlice, 0, len(k.slices))
+	for _, s := range k.slices {
+		slices = append(slices, s)
+	}
+	k.mu.Unlock()
+
+	var backends []Backend
+	for _, s := range slices {
+		port := k.port(s)
+		if port == 0 {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			ready := e.Conditions.Ready == nil || *e.Conditions.Ready
+			serving := e.Conditions.Serving != nil && *e.Conditions.Serving
+			terminating := e.Conditions.Terminating != nil && *e.Conditions.Terminating
+			if !ready && !(serving && terminating) {
+				continue
+			}
+			labels := map[string]string{}
+			if e.Zone != "" {
+				labels["zone"] = e.Zone
+			}
+			if e.NodeName != "" {
+				labels["node"] = e.NodeName
+			}
+			if e.TargetRef != nil && e.TargetRef.Name != "" {
+				labels["pod"] = e.TargetRef.Name
+			}
+			if e.Hints != nil && len(e.Hints.ForZones) > 0 {
+				var zones []string
+				for _, z := range e.Hints.ForZones {
+					zones = append(zones, z.Name)
+				}
+				labels["hints.zones"] = strings.Join(zones, ",")
+			}
+			for _, addr := range e.Addresses {
+				backends = append(backends, Backend{
+					URL: &url.URL{
+						Scheme: k.cfg.Scheme,
+						Host:   net.JoinHostPort(addr, strconv.Itoa(port)),
+					},
+					Labels:   labels,
+					Draining: !ready,
+				})
+			}
+		}
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].URL.String() < backends[j].URL.String()
+	})
+	k.syncer.Sync(backends)
+}
+
+// port returns the port of the EndpointSlice to use, or 0 if not found.
+func (k *Kubernetes) port(s endpointSlice) int {
+	for _, p := range s.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if k.cfg.Port == "" || (p.Name != nil && *p.Name == k.cfg.Port) {
+			return *p.Port
+		}
+	}
+	return 0
+}
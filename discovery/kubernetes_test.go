@@ -0,0 +1,206 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/olivere/balancers"
+)
+
+// fakeKubernetes is a minimal implementation of the EndpointSlice API of
+// Kubernetes that supports watches.
+type fakeKubernetes struct {
+	mu      sync.Mutex
+	list    string
+	events  chan string
+	queries []string
+}
+
+func newFakeKubernetes(list string) *fakeKubernetes {
+	return &fakeKubernetes{list: list, events: make(chan string)}
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices" || r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	k.mu.Lock()
+	k.queries = append(k.queries, r.URL.RawQuery)
+	list := k.list
+	k.mu.Unlock()
+
+	if r.URL.Query().Get("watch") == "" {
+		fmt.Fprint(w, list)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event, ok := <-k.events:
+			if !ok || event == "" {
+				return
+			}
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (k *fakeKubernetes) setList(list string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.list = list
+}
+
+func (k *fakeKubernetes) numQueries() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.queries)
+}
+
+const kubernetesSlice = `{
+	"metadata":{"name":"web-abc","resourceVersion":"10"},
+	"ports":[{"name":"metrics","port":9090},{"name":"http","port":8080}],
+	"endpoints":[
+		{"addresses":["10.0.0.1"],"conditions":{"ready":true},"nodeName":"n1","zone":"z1",
+		 "targetRef":{"kind":"Pod","name":"web-1"},"hints":{"forZones":[{"name":"z1"},{"name":"z2"}]}},
+		{"addresses":["10.0.0.2"],"conditions":{"ready":false,"serving":true,"terminating":true}},
+		{"addresses":["10.0.0.3"],"conditions":{"ready":false}},
+		{"addresses":["10.0.0.4"],"conditions":{}}
+	]
+}`
+
+func TestKubernetes(t *testing.T) {
+	api := newFakeKubernetes(`{"metadata":{"resourceVersion":"10"},"items":[` + kubernetesSlice + `]}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	var mu sync.Mutex
+	conns := make(map[string]*testConn)
+	balancer := newTestBalancer(t)
+	source, err := NewKubernetes(balancer, KubernetesConfig{
+		APIServer: server.URL,
+		Namespace: "prod",
+		Service:   "web",
+		Port:      "http",
+		Token:     "secret",
+		NewConnection: func(u *url.URL) balancers.Connection {
+			mu.Lock()
+			defer mu.Unlock()
+			conn := newTestConn(u).(*testConn)
+			conns[u.Host] = conn
+			return conn
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://10.0.0.1:8080 http://10.0.0.2:8080 http://10.0.0.4:8080]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	mu.Lock()
+	for host, tc := range conns {
+		switch host {
+		case "10.0.0.1:8080":
+			if tc.draining {
+				t.Errorf("expected %s to not be draining", tc.URL())
+			}
+			for k, v := range map[string]string{"zone": "z1", "node": "n1", "pod": "web-1", "hints.zones": "z1,z2"} {
+				if have := tc.labels[k]; have != v {
+					t.Errorf("expected label %s=%q; got: %q", k, v, have)
+				}
+			}
+		case "10.0.0.2:8080":
+			if !tc.draining {
+				t.Errorf("expected %s to be draining", tc.URL())
+			}
+		}
+	}
+	mu.Unlock()
+
+	// Changes arrive via the watch
+	api.events <- `{"type":"ADDED","object":{"metadata":{"name":"web-def","resourceVersion":"11"},"ports":[{"name":"http","port":8080}],"endpoints":[{"addresses":["10.0.1.1"]}]}}`
+	waitFor(t, func() bool {
+		return fmt.Sprint(urlsOf(balancer)) == "[http://10.0.0.1:8080 http://10.0.0.2:8080 http://10.0.0.4:8080 http://10.0.1.1:8080]"
+	})
+	api.events <- `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`
+	api.events <- `{"type":"DELETED","object":{"metadata":{"name":"web-abc","resourceVersion":"13"}}}`
+	waitFor(t, func() bool {
+		return fmt.Sprint(urlsOf(balancer)) == "[http://10.0.1.1:8080]"
+	})
+
+	// The watch resumes from the last resource version when it ends
+	api.events <- ""
+	waitFor(t, func() bool { return api.numQueries() >= 3 })
+
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if want, have := "labelSelector=kubernetes.io%2Fservice-name%3Dweb", api.queries[0]; want != have {
+		t.Errorf("expected query %q; got: %q", want, have)
+	}
+	if want, have := "allowWatchBookmarks=true&labelSelector=kubernetes.io%2Fservice-name%3Dweb&resourceVersion=10&watch=1", api.queries[1]; want != have {
+		t.Errorf("expected query %q; got: %q", want, have)
+	}
+	if want, have := "allowWatchBookmarks=true&labelSelector=kubernetes.io%2Fservice-name%3Dweb&resourceVersion=13&watch=1", api.queries[2]; want != have {
+		t.Errorf("expected query %q; got: %q", want, have)
+	}
+}
+
+func TestKubernetesRelistsWhenGone(t *testing.T) {
+	api := newFakeKubernetes(`{"metadata":{"resourceVersion":"10"},"items":[` + kubernetesSlice + `]}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	balancer := newTestBalancer(t)
+	source, err := NewKubernetes(balancer, KubernetesConfig{
+		APIServer:     server.URL,
+		Namespace:     "prod",
+		Service:       "web",
+		Token:         "secret",
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// Without a port name, the first port is used
+	if want, have := "[http://10.0.0.1:9090 http://10.0.0.2:9090 http://10.0.0.4:9090]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	api.setList(`{"metadata":{"resourceVersion":"20"},"items":[]}`)
+	api.events <- `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`
+	waitFor(t, func() bool { return len(urlsOf(balancer)) == 0 })
+	if err := source.Err(); err != nil {
+		t.Errorf("expected no error; got: %v", err)
+	}
+}
+
+func TestKubernetesErrors(t *testing.T) {
+	server := httptest.NewServer(newFakeKubernetes(`{}`))
+	defer server.Close()
+
+	if _, err := NewKubernetes(newTestBalancer(t), KubernetesConfig{APIServer: server.URL}); err == nil {
+		t.Error("expected error without service")
+	}
+	if _, err := NewKubernetes(newTestBalancer(t), KubernetesConfig{APIServer: server.URL, Namespace: "prod", Service: "web", Token: "wrong"}); err == nil {
+		t.Error("expected error for forbidden request")
+	}
+}
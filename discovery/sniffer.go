@@ -0,0 +1,278 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// SniffParser parses the response of a nodes endpoint into the list of
+// backends. base is the URL of the node that was asked; use it e.g. for
+// the scheme and credentials of the backends.
+type SniffParser func(base *url.URL, body []byte) ([]Backend, error)
+
+// SnifferConfig configures a Sniffer.
+type SnifferConfig struct {
+	// Seeds are the URLs of nodes to ask for the members of the cluster
+	// if none of the current connections of the balancer answers.
+	Seeds []string
+
+	// Path of the nodes endpoint. It defaults to "/_nodes/http".
+	Path string
+
+	// Parser parses the response of the nodes endpoint.
+	// It defaults to ParseElasticsearchNodes.
+	Parser SniffParser
+
+	// Client sends the requests to the nodes endpoint. It defaults to
+	// a client with a timeout of balancers.DefaultHealthCheckTimeout.
+	Client *http.Client
+
+	// Interval is the time between two sniffs. It defaults to
+	// DefaultRefreshInterval.
+	Interval time.Duration
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when sniffing fails. The balancer
+	// keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "sniffer".
+	Logger *slog.Logger
+}
+
+// Sniffer is a source that asks a cluster for its members, e.g. via the
+// /_nodes/http endpoint of Elasticsearch and OpenSearch, and keeps the
+// connections of the balancer in sync with them. It asks the healthy
+// connections of the balancer first and falls back to the seeds.
+type Sniffer struct {
+	cfg     SnifferConfig
+	updater balancers.Updater
+	seeds   []*url.URL
+	syncer  *Syncer
+	poller  *poller
+
+	mu      sync.Mutex // guards the following variables
+	lastErr error
+}
+
+// NewSniffer creates a new Sniffer for the given balancer. It sniffs
+// immediately and returns an error if that fails. Afterwards, it sniffs
+// periodically until closed.
+func NewSniffer(updater balancers.Updater, cfg SnifferConfig) (*Sniffer, error) {
+	var seeds []*url.URL
+	for _, rawurl := range cfg.Seeds {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, u)
+	}
+	if len(seeds) == 0 && len(updater.Connections()) == 0 {
+		return nil, errors.New("discovery: no seeds to sniff")
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/_nodes/http"
+	}
+	if cfg.Parser == nil {
+		cfg.Parser = ParseElasticsearchNodes
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: balancers.DefaultHealthCheckTimeout}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRefreshInterval
+	}
+	s := &Sniffer{
+		cfg:     cfg,
+		updater: updater,
+		seeds:   seeds,
+		syncer:  NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "sniffer")),
+	}
+	if err := s.Sniff(context.Background()); err != nil {
+		return nil, err
+	}
+	s.poller = newPoller(cfg.Clock, cfg.Interval, s.refresh)
+	return s, nil
+}
+
+// Close stops sniffing.
+func (s *Sniffer) Close() error {
+	return s.poller.Close()
+}
+
+// Err returns the error of the last sniff, if any.
+func (s *Sniffer) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// refresh sniffs and returns the time until the next sniff.
+func (s *Sniffer) refresh(ctx context.Context) time.Duration {
+	err := s.Sniff(ctx)
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	if err != nil {
+		s.syncer.reportError(err, s.cfg.OnError)
+	}
+	return s.cfg.Interval
+}
+
+// Sniff asks the cluster for its members and applies them to the balancer.
+func (s *Sniffer) Sniff(ctx context.Context) error {
+	var candidates []*url.URL
+	for _, c := range s.updater.Connections() {
+		if !c.IsBroken() {
+			candidates = append(candidates, c.URL())
+		}
+	}
+	candidates = append(candidates, s.seeds...)
+
+	err := errors.New("no nodes to sniff")
+	for _, u := range candidates {
+		var backends []Backend
+		backends, err = s.sniffNode(ctx, u)
+		if err == nil {
+			s.syncer.Sync(backends)
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("discovery: sniffing failed: %v", err)
+}
+
+// sniffNode asks a single node for the members of the cluster.
+func (s *Sniffer) sniffNode(ctx context.Context, base *url.URL) ([]Backend, error) {
+	ref, err := url.Parse(s.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", balancers.UserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("%s returned status code %d", base.Host, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := s.cfg.Parser(base, body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", base.Host, err)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%s returned no nodes", base.Host)
+	}
+	return backends, nil
+}
+
+// ParseElasticsearchNodes parses the response of the /_nodes/http endpoint
+// of Elasticsearch and OpenSearch. Every node with a HTTP publish address
+// becomes a backend with the scheme and credentials of base. The labels
+// of a backend contain the ID and name of the node as "node.id" and
+// "node.name", and the custom attributes of the node, e.g. its zone.
+func ParseElasticsearchNodes(base *url.URL, body []byte) ([]Backend, error) {
+	var doc struct {
+		Nodes map[string]struct {
+			Name       string            `json:"name"`
+			Attributes map[string]string `json:"attributes"`
+			HTTP       *struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(doc.Nodes))
+	for id := range doc.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var backends []Backend
+	for _, id := range ids {
+		node := doc.Nodes[id]
+		if node.HTTP == nil || node.HTTP.PublishAddress == "" {
+			continue
+		}
+		host, err := parsePublishAddress(node.HTTP.PublishAddress)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", id, err)
+		}
+		labels := map[string]string{
+			"node.id":   id,
+			"node.name": node.Name,
+		}
+		for k, v := range node.Attributes {
+			labels[k] = v
+		}
+		backends = append(backends, Backend{
+			URL:    &url.URL{Scheme: base.Scheme, User: base.User, Host: host},
+			Labels: labels,
+		})
+	}
+	return backends, nil
+}
+
+// parsePublishAddress returns the host and port of a publish address.
+// Publish addresses come as "1.2.3.4:9200", "[::1]:9200",
+// "hostname/1.2.3.4:9200", or "inet[/1.2.3.4:9200]" in old versions.
+// If a hostname is given, it is used instead of the IP address.
+func parsePublishAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, "inet[") && strings.HasSuffix(addr, "]") {
+		addr = addr[len("inet[") : len(addr)-1]
+	}
+	hostname := ""
+	if i := strings.Index(addr, "/"); i >= 0 {
+		hostname, addr = addr[:i], addr[i+1:]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid publish address %q", addr)
+	}
+	if hostname != "" {
+		host = hostname
+	}
+	return net.JoinHostPort(host, port), nil
+}
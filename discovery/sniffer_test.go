@@ -0,0 +1,157 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/balancers/clocktest"
+)
+
+func TestSniffer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		nodes string
+	)
+	setNodes := func(s string) {
+		mu.Lock()
+		nodes = s
+		mu.Unlock()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_nodes/http" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, nodes)
+	}))
+	defer server.Close()
+	serverHost := strings.TrimPrefix(server.URL, "http://")
+
+	setNodes(`{"nodes":{
+		"n1":{"name":"node-1","attributes":{"zone":"eu-1"},"http":{"publish_address":"` + serverHost + `"}},
+		"n2":{"name":"node-2","http":{"publish_address":"es2.local/10.0.0.2:9200"}},
+		"n3":{"name":"master-only"}
+	}}`)
+
+	clock := clocktest.NewClock(time.Now())
+	balancer := newTestBalancer(t)
+	source, err := NewSniffer(balancer, SnifferConfig{
+		Seeds:         []string{"http://127.0.0.1:1", server.URL},
+		Interval:      time.Minute,
+		Clock:         clock,
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	want := fmt.Sprintf("[%s http://es2.local:9200]", server.URL)
+	if have := fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	// The cluster changes. The next sniff asks the balancer's connections.
+	setNodes(`{"nodes":{
+		"n1":{"name":"node-1","http":{"publish_address":"` + serverHost + `"}},
+		"n3":{"name":"node-3","http":{"publish_address":"[::1]:9201"}}
+	}}`)
+	clock.Advance(time.Minute)
+	want = fmt.Sprintf("[%s http://[::1]:9201]", server.URL)
+	if have := fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	// Invalid responses keep the last good state
+	setNodes(`{"nodes":{}}`)
+	clock.Advance(time.Minute)
+	if have := fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	if source.Err() == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSnifferWithCustomParser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/members" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]string{"127.0.0.1:1", "127.0.0.1:2"})
+	}))
+	defer server.Close()
+
+	parser := func(base *url.URL, body []byte) ([]Backend, error) {
+		var members []string
+		if err := json.Unmarshal(body, &members); err != nil {
+			return nil, err
+		}
+		var backends []Backend
+		for _, m := range members {
+			backends = append(backends, Backend{URL: &url.URL{Scheme: "http", Host: m}})
+		}
+		return backends, nil
+	}
+
+	balancer := newTestBalancer(t)
+	source, err := NewSniffer(balancer, SnifferConfig{
+		Seeds:         []string{server.URL},
+		Path:          "/members",
+		Parser:        parser,
+		Clock:         clocktest.NewClock(time.Now()),
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "[http://127.0.0.1:1 http://127.0.0.1:2]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	// None of the balancer's connections answers, but the seed does
+	if err := source.Sniff(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePublishAddress(t *testing.T) {
+	tests := []struct {
+		Addr     string
+		Expected string
+	}{
+		{"10.0.0.1:9200", "10.0.0.1:9200"},
+		{"[::1]:9200", "[::1]:9200"},
+		{"es1.local/10.0.0.1:9200", "es1.local:9200"},
+		{"/10.0.0.1:9200", "10.0.0.1:9200"},
+		{"inet[/10.0.0.1:9200]", "10.0.0.1:9200"},
+		{"inet[es1.local/10.0.0.1:9200]", "es1.local:9200"},
+	}
+	for _, test := range tests {
+		have, err := parsePublishAddress(test.Addr)
+		if err != nil {
+			t.Errorf("%s: %v", test.Addr, err)
+			continue
+		}
+		if have != test.Expected {
+			t.Errorf("%s: expected %q; got: %q", test.Addr, test.Expected, have)
+		}
+	}
+	if _, err := parsePublishAddress("10.0.0.1"); err == nil {
+		t.Error("expected error for address without port")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+)
+
+// SRVResolver looks up SRV records. *net.Resolver implements SRVResolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVConfig configures a SRV source.
+type SRVConfig struct {
+	// Service, Proto, and Name specify the record to look up, i.e.
+	// _service._proto.name. If Service and Proto are empty, Name is
+	// looked up directly.
+	Service string
+	Proto   string
+	Name    string
+
+	// Scheme of the backends. It defaults to "http".
+	Scheme string
+
+	// Interval is the time between two lookups. It defaults to
+	// DefaultRefreshInterval.
+	Interval time.Duration
+
+	// Resolver to use. It defaults to net.DefaultResolver.
+	Resolver SRVResolver
+
+	// Clock to use for scheduling. It defaults to balancers.RealClock.
+	Clock balancers.Clock
+
+	// NewConnection creates the connection for a new backend.
+	// It defaults to balancers.NewHttpConnection.
+	NewConnection func(*url.URL) balancers.Connection
+
+	// OnError, if set, is called when a lookup fails. The balancer
+	// keeps its connections in that case.
+	OnError func(err error)
+
+	// Logger, if set, logs the backends that are added and removed, and
+	// errors. Messages have a "source" attribute of "srv".
+	Logger *slog.Logger
+}
+
+// SRV is a source that creates a connection for every target of a SRV
+// record. The priority of a record becomes the priority of the connection,
+// so balancers that honor priorities use the records with the lowest
+// priority and fail over to higher ones. The weight of a record becomes
+// the weight of the connection.
+type SRV struct {
+	cfg    SRVConfig
+	syncer *Syncer
+	poller *poller
+
+	mu      sync.Mutex // guards the following variables
+	lastErr error
+}
+
+// NewSRV creates a new SRV source for the given balancer. It looks up
+// the records immediately and returns an error if that fails. Afterwards,
+// it refreshes them periodically until closed.
+func NewSRV(updater balancers.Updater, cfg SRVConfig) (*SRV, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("discovery: missing SRV name")
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRefreshInterval
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	s := &SRV{
+		cfg:    cfg,
+		syncer: NewSyncer(updater, cfg.NewConnection).Logger(sourceLogger(cfg.Logger, "srv")),
+	}
+	if err := s.lookup(context.Background()); err != nil {
+		return nil, err
+	}
+	s.poller = newPoller(cfg.Clock, cfg.Interval, s.refresh)
+	return s, nil
+}
+
+// Close stops refreshing the records.
+func (s *SRV) Close() error {
+	return s.poller.Close()
+}
+
+// Err returns the error of the last lookup, if any.
+func (s *SRV) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// refresh looks up the records and returns the time until the next refresh.
+func (s *SRV) refresh(ctx context.Context) time.Duration {
+	err := s.lookup(ctx)
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	if err != nil {
+		s.syncer.reportError(err, s.cfg.OnError)
+	}
+	return s.cfg.Interval
+}
+
+// lookup looks up the records and applies them to the balancer.
+func (s *SRV) lookup(ctx context.Context) error {
+	_, records, err := s.cfg.Resolver.LookupSRV(ctx, s.cfg.Service, s.cfg.Proto, s.cfg.Name)
+	if err != nil {
+		return fmt.Errorf("discovery: looking up SRV records of %q: %v", s.cfg.Name, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("discovery: looking up SRV records of %q: %v", s.cfg.Name, errNoAddresses)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		if records[i].Target != records[j].Target {
+			return records[i].Target < records[j].Target
+		}
+		return records[i].Port < records[j].Port
+	})
+
+	backends := make([]Backend, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		u := &url.URL{
+			Scheme: s.cfg.Scheme,
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(r.Port))),
+		}
+		backends = append(backends, Backend{
+			URL:      u,
+			Weight:   int(r.Weight),
+			Priority: int(r.Priority),
+		})
+	}
+	s.syncer.Sync(backends)
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/clocktest"
+)
+
+type fakeSRVResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	name    string
+}
+
+func (r *fakeSRVResolver) set(records ...*net.SRV) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = records
+}
+
+func (r *fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.name = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	return r.name, r.records, nil
+}
+
+func TestSRV(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	resolver.set(
+		&net.SRV{Target: "backup.example.com.", Port: 9200, Priority: 20, Weight: 1},
+		&net.SRV{Target: "b.example.com.", Port: 9200, Priority: 10, Weight: 1},
+		&net.SRV{Target: "a.example.com.", Port: 9200, Priority: 10, Weight: 3},
+	)
+	clock := clocktest.NewClock(time.Now())
+	balancer := newTestBalancer(t)
+
+	source, err := NewSRV(balancer, SRVConfig{
+		Service:       "http",
+		Proto:         "tcp",
+		Name:          "search.example.com",
+		Interval:      time.Minute,
+		Resolver:      resolver,
+		Clock:         clock,
+		NewConnection: newTestConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if want, have := "_http._tcp.search.example.com", resolver.name; want != have {
+		t.Errorf("expected lookup of %q; got: %q", want, have)
+	}
+
+	// a (weight 3), b (weight 1), but not the backup
+	var visited []string
+	for i := 0; i < 5; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		visited = append(visited, conn.URL().Host)
+	}
+	want := "[a.example.com:9200 a.example.com:9200 b.example.com:9200 a.example.com:9200 a.example.com:9200]"
+	if have := fmt.Sprint(visited); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	// Records change
+	resolver.set(&net.SRV{Target: "c.example.com.", Port: 9300, Priority: 5, Weight: 0})
+	clock.Advance(time.Minute)
+	if want, have := "[http://c.example.com:9300]", fmt.Sprint(urlsOf(balancer)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	conn, err := balancer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := conn.(balancers.Weighted).Weight(); w != 1 {
+		t.Errorf("expected weight %d; got: %d", 1, w)
+	}
+	if p := conn.(balancers.Prioritized).Priority(); p != 5 {
+		t.Errorf("expected priority %d; got: %d", 5, p)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"time"
+)
+
+// HealthEvent describes a connection moving between healthy and broken.
+type HealthEvent struct {
+	// Conn is the connection that changed its state.
+	Conn Connection
+	// Time is when the state changed.
+	Time time.Time
+	// Broken is the new state of the connection.
+	Broken bool
+	// Reason describes why the state changed, e.g. "3 consecutive checks failed".
+	Reason string
+	// Err is the error of the last check, if any.
+	Err error
+	// StatusCode is the HTTP status code of the last check, if it
+	// failed because of an unexpected status code, and 0 otherwise.
+	StatusCode int
+}
+
+// Notifier is implemented by connections and balancers that report
+// changes of the health of their connections.
+type Notifier interface {
+	// Subscribe registers fn to be called whenever a connection moves
+	// between healthy and broken. Calling the returned function stops
+	// the notifications. fn is called synchronously and must not block.
+	Subscribe(fn func(HealthEvent)) (unsubscribe func())
+}
+
+// newHealthEvent creates a HealthEvent for conn.
+func newHealthEvent(conn Connection, t time.Time, broken bool, reason string, err error) HealthEvent {
+	ev := HealthEvent{
+		Conn:   conn,
+		Time:   t,
+		Broken: broken,
+		Reason: reason,
+		Err:    err,
+	}
+	if se, ok := err.(*StatusError); ok {
+		ev.StatusCode = se.StatusCode
+	}
+	return ev
+}
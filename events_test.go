@@ -0,0 +1,138 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpConnectionSubscribe(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url).RiseFall(1, 2)
+
+	var events []HealthEvent
+	unsubscribe := conn.Subscribe(func(ev HealthEvent) {
+		events = append(events, ev)
+	})
+
+	status = http.StatusServiceUnavailable
+	conn.checkBroken()
+	if len(events) != 0 {
+		t.Fatalf("expected %d events; got: %d", 0, len(events))
+	}
+	conn.checkBroken()
+	if len(events) != 1 {
+		t.Fatalf("expected %d events; got: %d", 1, len(events))
+	}
+	ev := events[0]
+	if ev.Conn != conn {
+		t.Errorf("expected connection %v; got: %v", conn, ev.Conn)
+	}
+	if !ev.Broken {
+		t.Error("expected connection to be broken")
+	}
+	if ev.Reason != "2 consecutive checks failed" {
+		t.Errorf("expected reason %q; got: %q", "2 consecutive checks failed", ev.Reason)
+	}
+	if ev.Err == nil {
+		t.Error("expected error")
+	}
+	if ev.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d; got: %d", http.StatusServiceUnavailable, ev.StatusCode)
+	}
+	if ev.Time.IsZero() {
+		t.Error("expected time")
+	}
+
+	status = http.StatusOK
+	conn.checkBroken()
+	if len(events) != 2 {
+		t.Fatalf("expected %d events; got: %d", 2, len(events))
+	}
+	if events[1].Broken {
+		t.Error("expected connection to not be broken")
+	}
+	if events[1].Err != nil {
+		t.Errorf("expected no error; got: %v", events[1].Err)
+	}
+
+	unsubscribe()
+	status = http.StatusServiceUnavailable
+	conn.checkBroken()
+	conn.checkBroken()
+	if len(events) != 2 {
+		t.Fatalf("expected %d events; got: %d", 2, len(events))
+	}
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+}
+
+func TestHttpConnectionSubscribeInOrder(t *testing.T) {
+	var n int32
+	checker := CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		if atomic.AddInt32(&n, 1)%2 == 0 {
+			return errors.New("down")
+		}
+		return nil
+	})
+	url, _ := url.Parse("http://localhost:12345")
+	conn := NewHttpConnectionWithOptions(url, HttpConnectionOptions{
+		Checker:           checker,
+		HeartbeatDuration: time.Hour,
+		Scheduler:         NewScheduler(),
+	})
+	defer conn.Close()
+
+	var mu sync.Mutex
+	var events []bool
+	conn.Subscribe(func(ev HealthEvent) {
+		// Let concurrent checks change the state in the meantime
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		mu.Lock()
+		events = append(events, ev.Broken)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				conn.checkBroken()
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		t.Fatal("expected events")
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i] == events[i-1] {
+			t.Fatalf("expected events to alternate; got broken = %v twice in a row at #%d", events[i], i)
+		}
+	}
+	if want, have := conn.IsBroken(), events[len(events)-1]; want != have {
+		t.Errorf("expected last event to report broken = %v; got: %v", want, have)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HealthCheck is a Checker that sends HTTP requests to a host.
+// The zero value sends a GET request to the URL of the connection
+// and expects a status code of 200 within DefaultHealthCheckTimeout.
+type HealthCheck struct {
+	// Path is resolved against the URL of the connection, e.g. "/healthz".
+	// It may contain a query string. If empty, the URL of the connection
+	// is used as is.
+	Path string
+
+	// Method is the HTTP method to use, e.g. "GET" or "HEAD".
+	// It defaults to "GET".
+	Method string
+
+	// Header is added to every health check request. Set "Host" to
+	// override the Host header.
+	Header http.Header
+
+	// Statuses is the list of status code ranges that are considered
+	// healthy. It defaults to 200 only.
+	Statuses []StatusRange
+
+	// Body, if set, must match the response body.
+	Body *regexp.Regexp
+
+	// JSONField, if set, is a dot-separated path to a field in the JSON
+	// response body, e.g. "status" or "cluster.health". The field must
+	// exist, and if JSONValue is non-empty, its value must be equal
+	// to JSONValue when formatted as a string.
+	JSONField string
+	JSONValue string
+
+	// Timeout is the time limit for a single health check.
+	// It defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+
+	// Transport is used to send the health check requests. It defaults
+	// to http.DefaultTransport. Use the same RoundTripper as the Base
+	// of the balancer's Transport to check hosts with the same TLS
+	// configuration (e.g. client certificates or a private CA) and proxy
+	// settings that are used for requests.
+	Transport http.RoundTripper
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Contains returns true if code is within the range.
+func (r StatusRange) Contains(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+// StatusError is returned by HealthCheck when a host responds with a
+// status code that is not accepted.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("health check: unexpected status code %d", e.StatusCode)
+}
+
+// maxHealthCheckBody is the maximum number of bytes read from the
+// response body of a health check.
+const maxHealthCheckBody = 1 << 20
+
+// Check performs the health check against the given URL. It returns nil
+// if the host is healthy and an error describing the problem otherwise.
+func (hc *HealthCheck) Check(ctx context.Context, u *url.URL) error {
+	if hc == nil {
+		hc = &HealthCheck{}
+	}
+
+	target := u
+	if hc.Path != "" {
+		ref, err := url.Parse(hc.Path)
+		if err != nil {
+			return fmt.Errorf("health check: invalid path %q: %v", hc.Path, err)
+		}
+		target = u.ResolveReference(ref)
+	}
+
+	method := hc.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return fmt.Errorf("health check: %v", err)
+	}
+	req = req.WithContext(ctx)
+	// Add UA to heartbeat requests.
+	req.Header.Add("User-Agent", UserAgent)
+	for k, v := range hc.Header {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			if len(v) > 0 {
+				req.Host = v[0]
+			}
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	cl := &http.Client{Transport: hc.Transport, Timeout: timeout}
+	res, err := cl.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check: %v", err)
+	}
+	defer res.Body.Close()
+
+	if !hc.acceptStatus(res.StatusCode) {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxHealthCheckBody))
+		return &StatusError{StatusCode: res.StatusCode}
+	}
+
+	if hc.Body == nil && hc.JSONField == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHealthCheckBody))
+	if err != nil {
+		return fmt.Errorf("health check: %v", err)
+	}
+	if hc.Body != nil && !hc.Body.Match(body) {
+		return fmt.Errorf("health check: body does not match %q", hc.Body.String())
+	}
+	if hc.JSONField != "" {
+		if err := hc.matchJSON(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withTransport returns a copy of checker that sends its requests with rt,
+// if checker is a *HealthCheck without a Transport of its own and rt is
+// set. Otherwise it returns checker.
+func withTransport(checker Checker, rt http.RoundTripper) Checker {
+	hc, ok := checker.(*HealthCheck)
+	if !ok || hc == nil || hc.Transport != nil || rt == nil {
+		return checker
+	}
+	clone := *hc
+	clone.Transport = rt
+	return &clone
+}
+
+// acceptStatus returns true if code is one of the accepted status codes.
+func (hc *HealthCheck) acceptStatus(code int) bool {
+	if len(hc.Statuses) == 0 {
+		return code == http.StatusOK
+	}
+	for _, r := range hc.Statuses {
+		if r.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchJSON checks the JSONField and JSONValue against the body.
+func (hc *HealthCheck) matchJSON(body []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("health check: invalid JSON: %v", err)
+	}
+	for _, name := range strings.Split(hc.JSONField, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("health check: field %q not found", hc.JSONField)
+		}
+		if v, ok = m[name]; !ok {
+			return fmt.Errorf("health check: field %q not found", hc.JSONField)
+		}
+	}
+	if hc.JSONValue != "" {
+		if have := fmt.Sprint(v); have != hc.JSONValue {
+			return fmt.Errorf("health check: expected field %q to be %q; got: %q", hc.JSONField, hc.JSONValue, have)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.WriteHeader(http.StatusNotFound)
+		case "/healthz":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if r.Header.Get("X-Token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"status":"green","cluster":{"nodes":3}}`)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		HealthCheck *HealthCheck
+		Healthy     bool
+	}{
+		{nil, false},
+		{&HealthCheck{}, false},
+		{&HealthCheck{Path: "/healthz"}, false},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}}, true},
+		{&HealthCheck{Path: "/healthz", Method: "HEAD"}, false},
+		{&HealthCheck{Path: "/healthz", Method: "HEAD", Statuses: []StatusRange{{200, 299}}}, true},
+		{&HealthCheck{Statuses: []StatusRange{{200, 299}, {404, 404}}}, true},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, Body: regexp.MustCompile(`"green"`)}, true},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, Body: regexp.MustCompile(`"red"`)}, false},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, JSONField: "status", JSONValue: "green"}, true},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, JSONField: "status", JSONValue: "yellow"}, false},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, JSONField: "cluster.nodes", JSONValue: "3"}, true},
+		{&HealthCheck{Path: "/healthz", Header: http.Header{"X-Token": {"secret"}}, JSONField: "cluster.name"}, false},
+		{&HealthCheck{Path: "/slow"}, true},
+		{&HealthCheck{Path: "/slow", Timeout: 100 * time.Millisecond}, false},
+	}
+
+	u, _ := url.Parse(server.URL)
+	for i, test := range tests {
+		err := test.HealthCheck.Check(context.Background(), u)
+		if test.Healthy && err != nil {
+			t.Errorf("#%d: expected healthy; got: %v", i, err)
+		}
+		if !test.Healthy && err == nil {
+			t.Errorf("#%d: expected check to fail", i)
+		}
+	}
+}
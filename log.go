@@ -0,0 +1,50 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+)
+
+// backendAttr returns the attribute that identifies a backend in logs.
+func backendAttr(u *url.URL) slog.Attr {
+	return slog.String("backend", u.Redacted())
+}
+
+// ErrorAttrs returns the attributes that describe err in logs: the error
+// itself as "error", its cause as "cause", and for a StatusError the
+// status code as "status_code". The cause is one of "no_connection"
+// for ErrNoConn, "status", "dns", "timeout", "canceled", or "error".
+// It is used by the packages of balancers to log errors consistently.
+func ErrorAttrs(err error) []slog.Attr {
+	attrs := []slog.Attr{slog.String("error", err.Error())}
+	var (
+		se   *StatusError
+		de   *net.DNSError
+		nerr net.Error
+	)
+	switch {
+	case errors.Is(err, ErrNoConn):
+		attrs = append(attrs, slog.String("cause", "no_connection"))
+	case errors.As(err, &se):
+		attrs = append(attrs, slog.String("cause", "status"), slog.Int("status_code", se.StatusCode))
+	case errors.As(err, &de):
+		cause := "dns"
+		if de.IsTimeout {
+			cause = "timeout"
+		}
+		attrs = append(attrs, slog.String("cause", cause))
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		attrs = append(attrs, slog.String("cause", "timeout"))
+	case errors.Is(err, context.Canceled):
+		attrs = append(attrs, slog.String("cause", "canceled"))
+	default:
+		attrs = append(attrs, slog.String("cause", "error"))
+	}
+	return attrs
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Observer is notified about the requests of a Transport and the health
+// checks of a Scheduler, e.g. to record metrics. Its methods are called
+// synchronously from many goroutines, so they must be safe for
+// concurrent use and return quickly. Embed NopObserver to implement only
+// some of the methods.
+type Observer interface {
+	// RequestStarted is called before a request is sent to conn.
+	RequestStarted(r *http.Request, conn Connection)
+
+	// RequestDone is called when the response headers of a request to
+	// conn have arrived, or the request has failed with err. elapsed is
+	// the time since the request was sent.
+	RequestDone(r *http.Request, conn Connection, res *http.Response, err error, elapsed time.Duration)
+
+	// RequestFinished is called when the response body of a request to
+	// conn has been read or closed, or right after RequestDone if the
+	// request has failed. Requests are in flight between RequestStarted
+	// and RequestFinished.
+	RequestFinished(r *http.Request, conn Connection)
+
+	// NoConnection is called when the balancer fails to return a
+	// connection for a request, typically with ErrNoConn.
+	NoConnection(r *http.Request, err error)
+
+	// HealthChecked is called after a health check of u with the
+	// result of the check and its duration.
+	HealthChecked(u *url.URL, err error, elapsed time.Duration)
+}
+
+// NopObserver is an Observer that does nothing.
+type NopObserver struct{}
+
+func (NopObserver) RequestStarted(r *http.Request, conn Connection) {}
+func (NopObserver) RequestDone(r *http.Request, conn Connection, res *http.Response, err error, elapsed time.Duration) {
+}
+func (NopObserver) RequestFinished(r *http.Request, conn Connection)           {}
+func (NopObserver) NoConnection(r *http.Request, err error)                    {}
+func (NopObserver) HealthChecked(u *url.URL, err error, elapsed time.Duration) {}
+
+// Ensure that NopObserver implements Observer.
+var _ Observer = NopObserver{}
@@ -0,0 +1,137 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the calls of an Observer.
+type recordingObserver struct {
+	NopObserver
+	mu    sync.Mutex
+	calls []string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) RequestStarted(r *http.Request, conn Connection) {
+	o.record("started %s", r.URL.Path)
+}
+
+func (o *recordingObserver) RequestDone(r *http.Request, conn Connection, res *http.Response, err error, elapsed time.Duration) {
+	if err != nil {
+		o.record("failed %s", r.URL.Path)
+	} else {
+		o.record("done %s %d", r.URL.Path, res.StatusCode)
+	}
+}
+
+func (o *recordingObserver) RequestFinished(r *http.Request, conn Connection) {
+	o.record("finished %s", r.URL.Path)
+}
+
+func (o *recordingObserver) NoConnection(r *http.Request, err error) {
+	o.record("no connection %s: %v", r.URL.Path, err)
+}
+
+func (o *recordingObserver) HealthChecked(u *url.URL, err error, elapsed time.Duration) {
+	o.record("checked %s: %v", u.Path, err)
+}
+
+func (o *recordingObserver) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return fmt.Sprintf("%q", o.calls)
+}
+
+// errorBalancer always fails with err.
+type errorBalancer struct {
+	err error
+}
+
+func (b *errorBalancer) Get() (Connection, error)  { return nil, b.err }
+func (b *errorBalancer) Connections() []Connection { return nil }
+
+func TestTransportObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(u)
+	defer conn.Close()
+
+	observer := &recordingObserver{}
+	transport := NewTransport(&testBalancer{conn: conn})
+	transport.Observer = observer
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://example.com/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	server.Close()
+	if _, err := client.Get("http://example.com/down"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+
+	transport = NewTransport(&errorBalancer{err: ErrNoConn})
+	transport.Observer = observer
+	client = &http.Client{Transport: transport}
+	if _, err := client.Get("http://example.com/none"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+
+	want := `["started /path" "done /path 202" "finished /path" "started /down" "failed /down" "finished /down" "no connection /none: no connection"]`
+	if have := observer.String(); want != have {
+		t.Errorf("expected calls %s; got: %s", want, have)
+	}
+}
+
+func TestSchedulerObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	first, second := &recordingObserver{}, &recordingObserver{}
+	s := NewScheduler().Observer(first).Observer(second)
+	u, _ := url.Parse(server.URL + "/health")
+	conn := NewHttpConnection(u).Scheduler(s).HeartbeatDuration(10 * time.Millisecond)
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		second.mu.Lock()
+		n := len(second.calls)
+		second.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for health check")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i, observer := range []*recordingObserver{first, second} {
+		observer.mu.Lock()
+		if want, have := "checked /health: <nil>", observer.calls[0]; want != have {
+			t.Errorf("#%d: expected %q; got: %q", i, want, have)
+		}
+		observer.mu.Unlock()
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+/*
+Package prometheus exports metrics of balancers to Prometheus.
+
+A Collector records the requests of a balancers.Transport and the health
+checks of a balancers.Scheduler, and reports the health of the
+connections of a balancer:
+
+	balancer, _ := roundrobin.NewBalancerFromURL("http://10.0.0.1:9200", "http://10.0.0.2:9200")
+	collector := prometheus.NewCollector(balancer, prometheus.Opts{})
+	registry.MustRegister(collector)
+
+	transport := balancers.NewTransport(balancer)
+	transport.Observer = collector
+	balancers.DefaultScheduler.Observer(collector)
+	client := &http.Client{Transport: transport}
+
+A Scheduler is usually shared by several balancers, so every collector
+added to it with Observer is notified about the health checks of all of
+them. A collector with a balancer only records the health checks of the
+backends of its balancer; one without a balancer records them all.
+
+Backends are identified by the scheme and host of their URL in the
+"backend" label. The series of a backend are deleted when the collector
+is scraped after the backend has left the balancer, so that discovery
+does not add series without bounds.
+
+The package is a module of its own, so that only programs that use it
+depend on the Prometheus client library.
+*/
+package prometheus
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/olivere/balancers"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Opts configure a Collector.
+type Opts struct {
+	// Namespace and Subsystem prefix the names of the metrics. Namespace
+	// defaults to "balancers".
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are added to all metrics, e.g. to tell several
+	// balancers apart.
+	ConstLabels prom.Labels
+
+	// Buckets of the latency histograms in seconds. They default to
+	// prometheus.DefBuckets.
+	Buckets []float64
+}
+
+// Collector is a prometheus.Collector and a balancers.Observer. It exports
+// these metrics:
+//
+//	requests_total{backend,code}                 counter, code is e.g. "2xx" or "error"
+//	request_duration_seconds{backend}            histogram, until the response headers arrive
+//	requests_in_flight{backend}                  gauge
+//	no_connection_total                          counter, requests without a connection
+//	backend_up{backend}                          gauge, 1 if healthy, 0 if broken
+//	health_check_duration_seconds{backend,result} histogram, result is "success" or "failure"
+type Collector struct {
+	balancers.NopObserver
+
+	balancer     balancers.Balancer
+	requests     *prom.CounterVec
+	latency      *prom.HistogramVec
+	inflight     *prom.GaugeVec
+	noConn       prom.Counter
+	up           *prom.Desc
+	healthChecks *prom.HistogramVec
+
+	mu       sync.Mutex     // guards the following variables
+	backends map[string]int // backends with series, and their requests in flight
+}
+
+// NewCollector creates a Collector for the given balancer. The health of
+// its connections is reported when the collector is scraped. The balancer
+// may be nil to only record requests and health checks.
+func NewCollector(balancer balancers.Balancer, opts Opts) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "balancers"
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prom.DefBuckets
+	}
+	name := func(name string) string {
+		return prom.BuildFQName(opts.Namespace, opts.Subsystem, name)
+	}
+	return &Collector{
+		balancer: balancer,
+		backends: make(map[string]int),
+		requests: prom.NewCounterVec(prom.CounterOpts{
+			Name:        name("requests_total"),
+			Help:        "Number of requests by backend and status code class.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"backend", "code"}),
+		latency: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:        name("request_duration_seconds"),
+			Help:        "Time until the response headers of a request arrive.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     opts.Buckets,
+		}, []string{"backend"}),
+		inflight: prom.NewGaugeVec(prom.GaugeOpts{
+			Name:        name("requests_in_flight"),
+			Help:        "Number of requests in flight, including reading the response body.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"backend"}),
+		noConn: prom.NewCounter(prom.CounterOpts{
+			Name:        name("no_connection_total"),
+			Help:        "Number of requests that failed because the balancer had no connection.",
+			ConstLabels: opts.ConstLabels,
+		}),
+		up: prom.NewDesc(
+			name("backend_up"),
+			"Whether the connection to a backend is healthy (1) or broken (0).",
+			[]string{"backend"},
+			opts.ConstLabels,
+		),
+		healthChecks: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:        name("health_check_duration_seconds"),
+			Help:        "Duration of health checks by backend and result.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     opts.Buckets,
+		}, []string{"backend", "result"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.requests.Describe(ch)
+	c.latency.Describe(ch)
+	c.inflight.Describe(ch)
+	c.noConn.Describe(ch)
+	ch <- c.up
+	c.healthChecks.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	var up []prom.Metric
+	if c.balancer != nil {
+		seen := make(map[string]bool)
+		for _, conn := range c.balancer.Connections() {
+			backend := backendOf(conn.URL())
+			if seen[backend] {
+				continue
+			}
+			seen[backend] = true
+			value := 1.0
+			if conn.IsBroken() {
+				value = 0
+			}
+			up = append(up, prom.MustNewConstMetric(c.up, prom.GaugeValue, value, backend))
+		}
+		c.forget(seen)
+	}
+
+	c.requests.Collect(ch)
+	c.latency.Collect(ch)
+	c.inflight.Collect(ch)
+	c.noConn.Collect(ch)
+	for _, m := range up {
+		ch <- m
+	}
+	c.healthChecks.Collect(ch)
+}
+
+// record remembers that backend has series and adds delta to the number
+// of its requests in flight.
+func (c *Collector) record(backend string, delta int) {
+	c.mu.Lock()
+	c.backends[backend] += delta
+	c.mu.Unlock()
+}
+
+// forget deletes the series of all backends that are not in current and
+// have no requests in flight.
+func (c *Collector) forget(current map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for backend, inflight := range c.backends {
+		if current[backend] || inflight > 0 {
+			continue
+		}
+		labels := prom.Labels{"backend": backend}
+		c.requests.DeletePartialMatch(labels)
+		c.latency.DeletePartialMatch(labels)
+		c.inflight.DeletePartialMatch(labels)
+		c.healthChecks.DeletePartialMatch(labels)
+		delete(c.backends, backend)
+	}
+}
+
+// RequestStarted implements balancers.Observer.
+func (c *Collector) RequestStarted(r *http.Request, conn balancers.Connection) {
+	backend := backendOf(conn.URL())
+	c.record(backend, 1)
+	c.inflight.WithLabelValues(backend).Inc()
+}
+
+// RequestDone implements balancers.Observer.
+func (c *Collector) RequestDone(r *http.Request, conn balancers.Connection, res *http.Response, err error, elapsed time.Duration) {
+	backend := backendOf(conn.URL())
+	code := "error"
+	if err == nil {
+		code = codeClass(res.StatusCode)
+	}
+	c.requests.WithLabelValues(backend, code).Inc()
+	c.latency.WithLabelValues(backend).Observe(elapsed.Seconds())
+}
+
+// RequestFinished implements balancers.Observer.
+func (c *Collector) RequestFinished(r *http.Request, conn balancers.Connection) {
+	backend := backendOf(conn.URL())
+	c.inflight.WithLabelValues(backend).Dec()
+	c.record(backend, -1)
+}
+
+// NoConnection implements balancers.Observer.
+func (c *Collector) NoConnection(r *http.Request, err error) {
+	c.noConn.Inc()
+}
+
+// HealthChecked implements balancers.Observer. Checks of backends that
+// are not in the balancer of the collector are ignored.
+func (c *Collector) HealthChecked(u *url.URL, err error, elapsed time.Duration) {
+	backend := backendOf(u)
+	if !c.owns(backend) {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.record(backend, 0)
+	c.healthChecks.WithLabelValues(backend, result).Observe(elapsed.Seconds())
+}
+
+// owns returns true if backend is in the balancer of the collector,
+// or if the collector has no balancer.
+func (c *Collector) owns(backend string) bool {
+	if c.balancer == nil {
+		return true
+	}
+	for _, conn := range c.balancer.Connections() {
+		if backendOf(conn.URL()) == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// backendOf returns the value of the backend label for u.
+func backendOf(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// codeClass returns the class of a HTTP status code, e.g. "2xx".
+func codeClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return string(rune('0'+code/100)) + "xx"
+}
+
+var (
+	// Ensure that Collector implements prometheus.Collector and
+	// balancers.Observer.
+	_ prom.Collector     = (*Collector)(nil)
+	_ balancers.Observer = (*Collector)(nil)
+)
@@ -0,0 +1,185 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/roundrobin"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	balancer, err := roundrobin.NewBalancerFromURL(server.URL, down.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+
+	collector := NewCollector(balancer, Opts{ConstLabels: prom.Labels{"balancer": "test"}, Buckets: []float64{60}})
+	registry := prom.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	scheduler := balancers.NewScheduler().Observer(collector)
+	// Checks of backends of other balancers on the same scheduler are ignored
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	for _, rawurl := range []string{server.URL, down.URL, other.URL} {
+		conn, _ := balancers.NewHttpConnectionFromURL(rawurl)
+		conn.Scheduler(scheduler).HealthCheck(&balancers.HealthCheck{})
+		defer conn.Close()
+	}
+
+	transport := balancers.NewTransport(balancer)
+	transport.Observer = collector
+	client := &http.Client{Transport: transport}
+	for _, path := range []string{"/", "/missing", "/"} {
+		res, err := client.Get("http://example.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := 1.0, testutil.ToFloat64(collector.inflight.WithLabelValues(server.URL)); want != have {
+			t.Errorf("expected %v requests in flight; got: %v", want, have)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	// An empty balancer has no connection
+	empty, _ := roundrobin.NewBalancer()
+	noConn := balancers.NewTransport(empty)
+	noConn.Observer = collector
+	if _, err := (&http.Client{Transport: noConn}).Get("http://example.com/"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+
+	expected := strings.NewReader(strings.Replace(strings.Replace(`
+# HELP balancers_backend_up Whether the connection to a backend is healthy (1) or broken (0).
+# TYPE balancers_backend_up gauge
+balancers_backend_up{backend="DOWN",balancer="test"} 0
+balancers_backend_up{backend="UP",balancer="test"} 1
+# HELP balancers_no_connection_total Number of requests that failed because the balancer had no connection.
+# TYPE balancers_no_connection_total counter
+balancers_no_connection_total{balancer="test"} 1
+# HELP balancers_requests_in_flight Number of requests in flight, including reading the response body.
+# TYPE balancers_requests_in_flight gauge
+balancers_requests_in_flight{backend="UP",balancer="test"} 0
+# HELP balancers_requests_total Number of requests by backend and status code class.
+# TYPE balancers_requests_total counter
+balancers_requests_total{backend="UP",balancer="test",code="2xx"} 2
+balancers_requests_total{backend="UP",balancer="test",code="4xx"} 1
+`, "UP", server.URL, -1), "DOWN", down.URL, -1))
+	err = testutil.GatherAndCompare(registry, expected,
+		"balancers_backend_up",
+		"balancers_no_connection_total",
+		"balancers_requests_in_flight",
+		"balancers_requests_total",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The durations vary, so only check the number of observations
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]uint64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			if h := m.GetHistogram(); h != nil {
+				key := mf.GetName()
+				for _, l := range m.GetLabel() {
+					if l.GetName() != "balancer" {
+						key += " " + l.GetValue()
+					}
+				}
+				counts[key] = h.GetSampleCount()
+			}
+		}
+	}
+	for key, want := range map[string]uint64{
+		"balancers_request_duration_seconds " + server.URL:                   3,
+		"balancers_health_check_duration_seconds " + server.URL + " success": 1,
+		"balancers_health_check_duration_seconds " + down.URL + " failure":   1,
+		"balancers_health_check_duration_seconds " + other.URL + " failure":  0,
+	} {
+		if have := counts[key]; want != have {
+			t.Errorf("expected %d observations of %s; got: %d", want, key, have)
+		}
+	}
+}
+
+func TestCollectorForgetsRemovedBackends(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			w.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer server.Close()
+
+	balancer, err := roundrobin.NewBalancerFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	collector := NewCollector(balancer, Opts{})
+	registry := prom.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	transport := balancers.NewTransport(balancer)
+	transport.Observer = collector
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	collector.HealthChecked(balancer.Connections()[0].URL(), nil, 0)
+	slow, err := client.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The series are kept while a request to the backend is in flight
+	balancer.Replace()
+	if n, err := testutil.GatherAndCount(registry, "balancers_requests_in_flight", "balancers_requests_total"); err != nil || n != 2 {
+		t.Fatalf("expected %d series; got: %d (%v)", 2, n, err)
+	}
+	close(release)
+	ioutil.ReadAll(slow.Body)
+	slow.Body.Close()
+
+	n, err := testutil.GatherAndCount(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, n; want != have {
+		t.Errorf("expected %d series after the backend was removed; got: %d", want, have)
+	}
+}
+
+func TestCodeClass(t *testing.T) {
+	for code, want := range map[int]string{200: "2xx", 301: "3xx", 404: "4xx", 503: "5xx", 99: "unknown", 600: "unknown"} {
+		if have := codeClass(code); want != have {
+			t.Errorf("expected %q for %d; got: %q", want, code, have)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Options configure a balancer created by New.
+type Options struct {
+	// Connections of the balancer. More can be added later by means of
+	// the Updater interface.
+	Connections []Connection
+
+	// PanicThreshold is the fraction of healthy connections below which
+	// the balancer ignores their health, for algorithms that support it.
+	// Zero disables panic mode.
+	PanicThreshold float64
+
+	// Params are settings specific to the algorithm, e.g. the number of
+	// choices of a power-of-two-choices balancer. New rejects params that
+	// the algorithm did not declare when it was registered.
+	Params map[string]string
+}
+
+// Named is implemented by balancers that report the name of their
+// algorithm, as registered with Register.
+type Named interface {
+	Algorithm() string
+}
+
+// Factory creates a balancer with the given options.
+type Factory func(opts Options) (Updater, error)
+
+// algorithm is a registered algorithm.
+type algorithm struct {
+	factory Factory
+	params  []string // sorted names of the accepted params
+}
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = make(map[string]algorithm)
+)
+
+// Register makes a balancer algorithm available by the given name, e.g.
+// "roundrobin". params are the names of the Options.Params that the
+// factory accepts. Register is typically called from the init function of
+// the package that implements the algorithm. It panics if it is called
+// twice with the same name or if factory is nil.
+func Register(name string, factory Factory, params ...string) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	if factory == nil {
+		panic("balancers: Register factory is nil")
+	}
+	if _, dup := algorithms[name]; dup {
+		panic("balancers: Register called twice for algorithm " + name)
+	}
+	params = append([]string(nil), params...)
+	sort.Strings(params)
+	algorithms[name] = algorithm{factory: factory, params: params}
+}
+
+// Algorithms returns the sorted names of the registered algorithms.
+func Algorithms() []string {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AlgorithmParams returns the sorted names of the params accepted by the
+// algorithm registered by the given name. It returns false if there is
+// no such algorithm.
+func AlgorithmParams(name string) ([]string, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	a, ok := algorithms[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), a.params...), true
+}
+
+// New creates a balancer of the algorithm registered by the given name.
+// It returns an error if opts has params that the algorithm does not
+// accept. Make sure to import the package of the algorithm, e.g.:
+//
+//	import _ "github.com/olivere/balancers/roundrobin"
+func New(name string, opts Options) (Updater, error) {
+	algorithmsMu.RLock()
+	a, ok := algorithms[name]
+	algorithmsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("balancers: unknown algorithm %q (forgotten import?)", name)
+	}
+	for _, param := range sortedKeys(opts.Params) {
+		if !contains(a.params, param) {
+			return nil, fmt.Errorf("balancers: algorithm %q does not accept param %q", name, param)
+		}
+	}
+	return a.factory(opts)
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contains returns true if the sorted list contains s.
+func contains(list []string, s string) bool {
+	i := sort.SearchStrings(list, s)
+	return i < len(list) && list[i] == s
+}
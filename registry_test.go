@@ -0,0 +1,78 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testUpdater is a minimal Updater for the registry tests.
+type testUpdater struct {
+	testBalancer
+	opts Options
+}
+
+func (b *testUpdater) Add(conns ...Connection)     {}
+func (b *testUpdater) Remove(conns ...Connection)  {}
+func (b *testUpdater) Replace(conns ...Connection) {}
+
+func TestRegistry(t *testing.T) {
+	Register("test", func(opts Options) (Updater, error) {
+		if v, ok := opts.Params["fail"]; ok {
+			return nil, fmt.Errorf("test: %s", v)
+		}
+		return &testUpdater{opts: opts}, nil
+	}, "fail", "choices")
+	defer func() {
+		algorithmsMu.Lock()
+		delete(algorithms, "test")
+		algorithmsMu.Unlock()
+	}()
+
+	found := false
+	for _, name := range Algorithms() {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Errorf("expected %q in %v", "test", Algorithms())
+	}
+
+	b, err := New("test", Options{PanicThreshold: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0.5, b.(*testUpdater).opts.PanicThreshold; want != have {
+		t.Errorf("expected panic threshold %v; got: %v", want, have)
+	}
+	if _, err := New("test", Options{Params: map[string]string{"fail": "invalid"}}); err == nil || err.Error() != "test: invalid" {
+		t.Errorf("expected error from factory; got: %v", err)
+	}
+	if params, ok := AlgorithmParams("test"); !ok || fmt.Sprint(params) != "[choices fail]" {
+		t.Errorf("expected params %s; got: %v", "[choices fail]", params)
+	}
+	if _, ok := AlgorithmParams("unknown"); ok {
+		t.Error("expected no params for unknown algorithm")
+	}
+	if _, err := New("test", Options{Params: map[string]string{"choices": "2", "bias": "1"}}); err == nil || err.Error() != `balancers: algorithm "test" does not accept param "bias"` {
+		t.Errorf("expected error for unknown param; got: %v", err)
+	}
+	if _, err := New("unknown", Options{}); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+}
+
+func TestRegisterPanicsOnDuplicates(t *testing.T) {
+	factory := func(opts Options) (Updater, error) { return &testUpdater{}, nil }
+	Register("dup", factory)
+	defer func() {
+		algorithmsMu.Lock()
+		delete(algorithms, "dup")
+		algorithmsMu.Unlock()
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	Register("dup", factory)
+}
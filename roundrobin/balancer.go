@@ -4,93 +4,575 @@
 package roundrobin
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 
 	"github.com/olivere/balancers"
 )
 
 // Balancer implements a round-robin balancer.
+//
+// Connections that implement balancers.Weighted receive requests in
+// proportion to their weight. Requests are interleaved by smooth weighted
+// round-robin like in nginx, so a connection with a high weight does not
+// receive its share in bursts. Connections that implement
+// balancers.Prioritized are only used if there are no healthy
+// connections with a lower priority value.
 type Balancer struct {
-	sync.Mutex // guards the following variables
-	conns      []balancers.Connection
-	idx        int // index into conns
+	sync.Mutex     // guards the following variables
+	conns          []balancers.Connection
+	current        []int   // current weights of conns
+	panicThreshold float64 // healthy fraction below which health is ignored
+	panicking      bool    // true while the balancer ignores health
+	healthy, total int     // connections counted by the last call of Get
+	panicPending   bool    // panic mode changed and is yet to be reported
+	reporting      bool    // a goroutine reports changes of panic mode
+	panicReported  bool    // panic mode as last reported, guarded by reporting
+	panicHandler   func(panicking bool, healthy, total int)
+	logger         *slog.Logger
+	transport      http.RoundTripper               // used by the health checks of HttpConnections
+	unsubscribe    map[balancers.Connection]func() // members, and how to stop their health events
+	subscribers    map[uint64]func(balancers.HealthEvent)
+	nextSubscriber uint64
 }
 
 // NewBalancer creates a new round-robin balancer. It can be initializes by
 // a variable number of connections. To use plain URLs instead of
 // connections, use NewBalancerFromURL.
 func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
-	b := &Balancer{
-		conns: make([]balancers.Connection, 0),
-	}
-	if len(conns) > 0 {
-		b.conns = append(b.conns, conns...)
+	b := newBalancer()
+	for _, c := range conns {
+		b.add(c)
 	}
 	return b, nil
 }
 
 // NewBalancerFromURL creates a new round-robin balancer for the
 // given list of URLs. It returns an error if any of the URLs is invalid.
+// URLs may contain options like the weight of a connection, e.g.
+// "https://host:9200?weight=3&zone=eu-1&health=/healthz"; see
+// balancers.NewHttpConnectionFromURL.
 func NewBalancerFromURL(urls ...string) (*Balancer, error) {
-	b := &Balancer{
-		conns: make([]balancers.Connection, 0),
-	}
+	b := newBalancer()
 	for _, rawurl := range urls {
-		if u, err := url.Parse(rawurl); err != nil {
+		conn, err := balancers.NewHttpConnectionFromURL(rawurl)
+		if err != nil {
+			b.Close()
 			return nil, err
-		} else {
-			b.conns = append(b.conns, balancers.NewHttpConnection(u))
 		}
+		b.add(conn)
 	}
 	return b, nil
 }
 
+func init() {
+	balancers.Register("roundrobin", newBalancerFromOptions)
+}
+
+// newBalancerFromOptions creates a round-robin balancer by means of
+// balancers.New. The balancer has no params.
+func newBalancerFromOptions(opts balancers.Options) (balancers.Updater, error) {
+	b := newBalancer()
+	for _, c := range opts.Connections {
+		b.add(c)
+	}
+	return b.PanicThreshold(opts.PanicThreshold), nil
+}
+
+func newBalancer() *Balancer {
+	return &Balancer{
+		conns:       make([]balancers.Connection, 0),
+		unsubscribe: make(map[balancers.Connection]func()),
+		subscribers: make(map[uint64]func(balancers.HealthEvent)),
+	}
+}
+
+// add appends conn to the list of connections and forwards its health
+// events to the subscribers of the balancer, unless conn is already part
+// of the balancer. It returns true if conn was added. The caller must hold
+// the lock if the balancer is in use.
+func (b *Balancer) add(conn balancers.Connection) bool {
+	if _, found := b.unsubscribe[conn]; found {
+		return false
+	}
+	b.conns = append(b.conns, conn)
+	b.current = append(b.current, 0)
+	if n, ok := conn.(balancers.Notifier); ok {
+		b.unsubscribe[conn] = n.Subscribe(b.notify)
+	} else {
+		b.unsubscribe[conn] = func() {}
+	}
+	return true
+}
+
+// remove removes the i-th connection and stops forwarding its health
+// events. The caller must hold the lock.
+func (b *Balancer) remove(i int) balancers.Connection {
+	conn := b.conns[i]
+	b.conns = append(b.conns[:i], b.conns[i+1:]...)
+	b.current = append(b.current[:i], b.current[i+1:]...)
+	b.unsubscribe[conn]()
+	delete(b.unsubscribe, conn)
+	return conn
+}
+
+// Add adds connections to the balancer. Connections that are already
+// part of the balancer are ignored.
+func (b *Balancer) Add(conns ...balancers.Connection) {
+	var added []balancers.Connection
+	b.Lock()
+	for _, c := range conns {
+		if b.add(c) {
+			added = append(added, c)
+		}
+	}
+	transport := b.transport
+	b.Unlock()
+
+	if transport != nil {
+		useTransport(added, transport)
+	}
+}
+
+// Remove removes conns from the balancer. Removed connections that
+// implement io.Closer are closed.
+func (b *Balancer) Remove(conns ...balancers.Connection) {
+	remove := make(map[balancers.Connection]bool)
+	for _, c := range conns {
+		remove[c] = true
+	}
+
+	var removed []balancers.Connection
+	b.Lock()
+	for i := len(b.conns) - 1; i >= 0; i-- {
+		if remove[b.conns[i]] {
+			removed = append(removed, b.remove(i))
+		}
+	}
+	b.Unlock()
+
+	closeAll(removed)
+}
+
+// Replace atomically replaces the connections of the balancer by conns.
+// Previous connections that are not part of conns and implement
+// io.Closer are closed. The current weights of the connections that
+// remain are retained, so the distribution of requests continues where
+// it left off.
+func (b *Balancer) Replace(conns ...balancers.Connection) {
+	keep := make(map[balancers.Connection]bool)
+	for _, c := range conns {
+		keep[c] = true
+	}
+
+	var added, removed []balancers.Connection
+	b.Lock()
+	previous := make(map[balancers.Connection]int) // current weights
+	for i := len(b.conns) - 1; i >= 0; i-- {
+		if keep[b.conns[i]] {
+			previous[b.conns[i]] = b.current[i]
+		} else {
+			removed = append(removed, b.remove(i))
+		}
+	}
+	b.conns, b.current = b.conns[:0], b.current[:0]
+	seen := make(map[balancers.Connection]bool)
+	for _, c := range conns {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		if weight, found := previous[c]; found {
+			b.conns = append(b.conns, c)
+			b.current = append(b.current, weight)
+		} else if b.add(c) {
+			added = append(added, c)
+		}
+	}
+	transport := b.transport
+	b.Unlock()
+
+	if transport != nil {
+		useTransport(added, transport)
+	}
+	closeAll(removed)
+}
+
+// Close removes all connections from the balancer and closes those that
+// implement io.Closer. This stops the heartbeats of the connections
+// created by NewBalancerFromURL. The balancer returns ErrNoConn afterwards.
+func (b *Balancer) Close() error {
+	b.Lock()
+	var removed []balancers.Connection
+	for i := len(b.conns) - 1; i >= 0; i-- {
+		removed = append(removed, b.remove(i))
+	}
+	b.Unlock()
+
+	return closeAll(removed)
+}
+
+// closeAll closes all connections that implement io.Closer.
+// It returns the first error encountered.
+func closeAll(conns []balancers.Connection) error {
+	var err error
+	for _, c := range conns {
+		if closer, ok := c.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Subscribe registers fn to be called whenever one of the connections
+// of the balancer moves between healthy and broken. Only connections
+// that implement balancers.Notifier report changes. Calling the
+// returned function stops the notifications. fn is called synchronously
+// and must not block.
+func (b *Balancer) Subscribe(fn func(balancers.HealthEvent)) func() {
+	b.Lock()
+	defer b.Unlock()
+	b.nextSubscriber++
+	id := b.nextSubscriber
+	b.subscribers[id] = fn
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// notify passes ev to all subscribers.
+func (b *Balancer) notify(ev balancers.HealthEvent) {
+	b.Lock()
+	fns := make([]func(balancers.HealthEvent), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		fns = append(fns, fn)
+	}
+	b.Unlock()
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
+
+// PanicThreshold sets the fraction of healthy connections (between 0 and 1)
+// below which the balancer stops trusting the health of its connections.
+// The fraction is computed per priority: connections with a higher
+// priority value are used while the lower priorities have too few healthy
+// connections. Only if no priority has enough, the balancer enters panic
+// mode and distributes requests over all connections of the lowest
+// priority with healthy connections, whether they are broken or not.
+// This prevents a flapping health check from taking all backends out of
+// rotation. The default of 0 disables panic mode.
+func (b *Balancer) PanicThreshold(threshold float64) *Balancer {
+	b.Lock()
+	defer b.Unlock()
+	b.panicThreshold = threshold
+	return b
+}
+
+// PanicHandler registers a function that is called whenever the balancer
+// enters or leaves panic mode. It is passed the new state along with the
+// number of healthy connections and the total number of connections.
+// Calls of fn are serialized and report the changes in order, so fn sees
+// panic mode entered and left alternately. fn is called by one of the
+// calls of Get, after the state has changed.
+func (b *Balancer) PanicHandler(fn func(panicking bool, healthy, total int)) *Balancer {
+	b.Lock()
+	defer b.Unlock()
+	b.panicHandler = fn
+	return b
+}
+
+// Logger sets the logger of the balancer. It logs when the balancer
+// enters or leaves panic mode, and when Get returns ErrNoConn. Changes of
+// the health of connections are logged by the connections, see e.g.
+// balancers.HttpConnection.Logger. Passing nil disables logging, which is
+// the default.
+func (b *Balancer) Logger(logger *slog.Logger) *Balancer {
+	b.Lock()
+	defer b.Unlock()
+	b.logger = logger
+	return b
+}
+
+// IsPanicking returns true if the balancer is currently in panic mode,
+// i.e. it ignores the health of its connections. See PanicThreshold.
+func (b *Balancer) IsPanicking() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.panicking
+}
+
+// State returns the number of healthy connections, the total number of
+// connections, and whether the balancer is in panic mode, as counted by
+// the last call of Get.
+func (b *Balancer) State() balancers.BalancerState {
+	b.Lock()
+	defer b.Unlock()
+	return balancers.BalancerState{
+		Healthy:   b.healthy,
+		Total:     b.total,
+		Panicking: b.panicking,
+	}
+}
+
+// Transport sets the RoundTripper used by the health checks of all
+// connections of type *balancers.HttpConnection, including those added
+// later. Pass the Base of the balancers.Transport to check hosts with the
+// same TLS and proxy settings that are used for requests. A
+// balancers.Transport with a Base does this by itself. The connections
+// are checked again concurrently, and Transport returns when all checks
+// are done.
+func (b *Balancer) Transport(rt http.RoundTripper) *Balancer {
+	useTransport(b.setTransport(rt), rt)
+	return b
+}
+
+// SetHealthCheckTransport implements balancers.HealthCheckTransporter.
+// Unlike Transport, it checks the connections in the background, so that
+// it does not delay the request that triggered it.
+func (b *Balancer) SetHealthCheckTransport(rt http.RoundTripper) {
+	go useTransport(b.setTransport(rt), rt)
+}
+
+// setTransport sets the RoundTripper for the health checks of connections
+// added later, and returns the current connections.
+func (b *Balancer) setTransport(rt http.RoundTripper) []balancers.Connection {
+	b.Lock()
+	defer b.Unlock()
+	b.transport = rt
+	return append([]balancers.Connection(nil), b.conns...)
+}
+
+// useTransport sets the RoundTripper of the health checks of conns of
+// type *balancers.HttpConnection. Each of them is checked immediately,
+// so they are checked concurrently.
+func useTransport(conns []balancers.Connection, rt http.RoundTripper) {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		if hc, ok := c.(*balancers.HttpConnection); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				hc.Transport(rt)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
 // Get returns a connection from the balancer that can be used for the next request.
 // ErrNoConn is returns when no connection is available.
 func (b *Balancer) Get() (balancers.Connection, error) {
 	b.Lock()
-	defer b.Unlock()
 
-	if len(b.conns) == 0 {
-		return nil, balancers.ErrNoConn
+	// Count the connections by priority. Only the connections of one
+	// priority, the tier, are used: the lowest priority with enough
+	// healthy connections, i.e. at least the panic threshold.
+	type count struct{ priority, healthy, total int }
+	var tiers []count
+	healthy, total := 0, 0
+	for _, c := range b.conns {
+		if isDraining(c) {
+			continue
+		}
+		p := priorityOf(c)
+		i := sort.Search(len(tiers), func(i int) bool { return tiers[i].priority >= p })
+		if i == len(tiers) || tiers[i].priority != p {
+			tiers = append(tiers, count{})
+			copy(tiers[i+1:], tiers[i:])
+			tiers[i] = count{priority: p}
+		}
+		total++
+		tiers[i].total++
+		if !c.IsBroken() {
+			healthy++
+			tiers[i].healthy++
+		}
 	}
-
-	var conn balancers.Connection
-	for i := 0; i < len(b.conns); i++ {
-		candidate := b.conns[b.idx]
-		b.idx = (b.idx + 1) % len(b.conns)
-		if !candidate.IsBroken() {
-			conn = candidate
+	tier, found := 0, false
+	for _, t := range tiers {
+		if t.healthy > 0 && float64(t.healthy) >= b.panicThreshold*float64(t.total) {
+			tier, found = t.priority, true
 			break
 		}
 	}
+	// If no priority has enough healthy connections, panic: use all
+	// connections of the lowest priority with healthy connections, or of
+	// the lowest priority if there are none, whether they are broken or not.
+	panicking := !found && b.panicThreshold > 0 && total > 0
+	if panicking {
+		tier = tiers[0].priority
+		for _, t := range tiers {
+			if t.healthy > 0 {
+				tier = t.priority
+				break
+			}
+		}
+	}
+	b.healthy, b.total = healthy, total
+	report := false
+	if panicking != b.panicking {
+		b.panicking = panicking
+		b.panicPending = true
+		if !b.reporting {
+			b.reporting, report = true, true
+		}
+	}
 
+	// Smooth weighted round-robin: every usable connection gains its
+	// weight, and the one with the highest current weight is used and
+	// loses the sum of the weights. A connection with weight n is used n
+	// times per round, interleaved with the other connections.
+	var (
+		conn      balancers.Connection
+		best, sum int
+	)
+	for i, c := range b.conns {
+		usable := !isDraining(c) && priorityOf(c) == tier && (panicking || !c.IsBroken())
+		if !usable {
+			continue
+		}
+		weight := weightOf(c)
+		b.current[i] += weight
+		sum += weight
+		if conn == nil || b.current[i] > b.current[best] {
+			conn, best = c, i
+		}
+	}
+	if conn != nil {
+		b.current[best] -= sum
+	}
+	logger := b.logger
+	b.Unlock()
+
+	if report {
+		b.reportPanic()
+	}
 	if conn == nil {
+		if logger != nil {
+			attrs := append(balancers.ErrorAttrs(balancers.ErrNoConn), slog.Int("healthy", healthy), slog.Int("total", total))
+			logger.LogAttrs(context.Background(), slog.LevelWarn, "no connection", attrs...)
+		}
 		return nil, balancers.ErrNoConn
 	}
 	return conn, nil
 }
 
+// reportPanic passes changes of panic mode to the logger and the panic
+// handler until there are no more. Only one goroutine reports at a time,
+// so changes are reported in order even if concurrent calls of Get
+// change the state.
+func (b *Balancer) reportPanic() {
+	for {
+		b.Lock()
+		if !b.panicPending {
+			b.reporting = false
+			b.Unlock()
+			return
+		}
+		b.panicPending = false
+		panicking, healthy, total := b.panicking, b.healthy, b.total
+		handler, logger := b.panicHandler, b.logger
+		b.Unlock()
+
+		if panicking == b.panicReported {
+			continue
+		}
+		b.panicReported = panicking
+		if logger != nil {
+			if panicking {
+				logger.Warn("panic mode entered", "healthy", healthy, "total", total)
+			} else {
+				logger.Info("panic mode left", "healthy", healthy, "total", total)
+			}
+		}
+		if handler != nil {
+			handler(panicking, healthy, total)
+		}
+	}
+}
+
+// isDraining returns true if conn must not receive new requests.
+func isDraining(conn balancers.Connection) bool {
+	d, ok := conn.(balancers.Drainer)
+	return ok && d.IsDraining()
+}
+
+// weightOf returns the weight of conn, which is at least 1.
+func weightOf(conn balancers.Connection) int {
+	if w, ok := conn.(balancers.Weighted); ok && w.Weight() > 1 {
+		return w.Weight()
+	}
+	return 1
+}
+
+// priorityOf returns the priority of conn.
+func priorityOf(conn balancers.Connection) int {
+	if p, ok := conn.(balancers.Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
 // Connections returns a list of all connections.
 func (b *Balancer) Connections() []balancers.Connection {
 	b.Lock()
 	defer b.Unlock()
 	conns := make([]balancers.Connection, len(b.conns))
 	for i, c := range b.conns {
-		if oc, ok := c.(*balancers.HttpConnection); ok {
-			// Make a clone
-			cr := &simpleConn{
-				url:    oc.URL(),
-				broken: oc.IsBroken(),
-			}
-			conns[i] = cr
+		// Make a clone
+		cr := &simpleConn{
+			url:    c.URL(),
+			broken: c.IsBroken(),
 		}
+		conns[i] = cr
 	}
 	return conns
 }
 
+// Algorithm returns "roundrobin", the name of the algorithm of the
+// balancer in the registry of balancers.
+func (b *Balancer) Algorithm() string {
+	return "roundrobin"
+}
+
+// Stats returns a snapshot of the state and the requests of every
+// connection of the balancer. See balancers.PublishStats to publish
+// them via expvar.
+func (b *Balancer) Stats() []balancers.ConnectionStats {
+	b.Lock()
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	b.Unlock()
+
+	stats := make([]balancers.ConnectionStats, len(conns))
+	for i, c := range conns {
+		stats[i] = balancers.StatsOf(c)
+	}
+	return stats
+}
+
 var (
+	// Ensure that Balancer implements balancers.Named, balancers.Notifier,
+	// balancers.Updater, balancers.StatsReporter, balancers.StateReporter,
+	// balancers.HealthCheckTransporter, and io.Closer.
+	_ balancers.Named                  = (*Balancer)(nil)
+	_ balancers.Notifier               = (*Balancer)(nil)
+	_ balancers.Updater                = (*Balancer)(nil)
+	_ balancers.StatsReporter          = (*Balancer)(nil)
+	_ balancers.StateReporter          = (*Balancer)(nil)
+	_ balancers.HealthCheckTransporter = (*Balancer)(nil)
+	_ io.Closer                        = (*Balancer)(nil)
+
 	// Ensure that simpleConn make implements balancers.Connection.
 	_ balancers.Connection = (*simpleConn)(nil)
 )
@@ -4,13 +4,20 @@
 package roundrobin
 
 import (
+	"bytes"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/clocktest"
 )
 
 func TestNewBalancer(t *testing.T) {
@@ -142,6 +149,215 @@ func TestBalancerWithBrokenConnections(t *testing.T) {
 	}
 }
 
+type testConn struct {
+	url    *url.URL
+	broken bool
+}
+
+func (c *testConn) URL() *url.URL  { return c.url }
+func (c *testConn) IsBroken() bool { return c.broken }
+
+func newTestConn(rawurl string, broken bool) *testConn {
+	u, _ := url.Parse(rawurl)
+	return &testConn{url: u, broken: broken}
+}
+
+func TestBalancerPanicThreshold(t *testing.T) {
+	conn1 := newTestConn("http://127.0.0.1:12345", true)
+	conn2 := newTestConn("http://127.0.0.1:23456", true)
+	conn3 := newTestConn("http://127.0.0.1:34567", false)
+
+	var events []bool
+	b, err := NewBalancer(conn1, conn2, conn3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := b.(*Balancer).PanicThreshold(0.5).PanicHandler(func(panicking bool, healthy, total int) {
+		if total != 3 {
+			t.Errorf("expected %d connections; got: %d", 3, total)
+		}
+		events = append(events, panicking)
+	})
+
+	// 1 of 3 is healthy, so we're below the threshold: use all connections
+	for i, want := range []balancers.Connection{conn1, conn2, conn3, conn1} {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("%d: expected %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+	if !balancer.IsPanicking() {
+		t.Error("expected balancer to be in panic mode")
+	}
+	if want, have := (balancers.BalancerState{Healthy: 1, Total: 3, Panicking: true}), balancer.State(); want != have {
+		t.Errorf("expected state %+v; got: %+v", want, have)
+	}
+
+	// 2 of 3 are healthy: leave panic mode and skip broken connections
+	conn1.broken = false
+	for i, want := range []balancers.Connection{conn3, conn3, conn1} {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("%d: expected %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+	if balancer.IsPanicking() {
+		t.Error("expected balancer to not be in panic mode")
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected %d events; got: %d", 2, len(events))
+	}
+	if !events[0] {
+		t.Error("expected 1st event to enter panic mode")
+	}
+	if events[1] {
+		t.Error("expected 2nd event to leave panic mode")
+	}
+}
+
+// flappingConn is a connection whose health may change concurrently.
+type flappingConn struct {
+	testConn
+	flapping atomic.Bool
+}
+
+func (c *flappingConn) IsBroken() bool { return c.flapping.Load() }
+
+func TestBalancerPanicHandlerIsCalledInOrder(t *testing.T) {
+	conn := &flappingConn{testConn: *newTestConn("http://127.0.0.1:12345", false)}
+	b, err := NewBalancer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		events []bool
+	)
+	balancer := b.(*Balancer).PanicThreshold(0.5).PanicHandler(func(panicking bool, healthy, total int) {
+		time.Sleep(time.Millisecond) // let concurrent calls overtake
+		mu.Lock()
+		events = append(events, panicking)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if j%10 == 0 {
+					conn.flapping.Store(!conn.flapping.Load())
+				}
+				balancer.Get()
+			}
+		}()
+	}
+	wg.Wait()
+	balancer.Get()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, panicking := range events {
+		if want := i%2 == 0; panicking != want {
+			t.Fatalf("#%d: expected panicking = %v; got: %v", i, want, panicking)
+		}
+	}
+	if len(events) > 0 && events[len(events)-1] != balancer.IsPanicking() {
+		t.Errorf("expected last event to match the state of the balancer")
+	}
+}
+
+func TestBalancerPanicThresholdWithPriorities(t *testing.T) {
+	var primaries, failovers []*weightedConn
+	var conns []balancers.Connection
+	for i := 0; i < 4; i++ {
+		c := newWeightedConn(fmt.Sprintf("http://primary%d:9200", i), 1, 0)
+		c.broken = true
+		primaries = append(primaries, c)
+		conns = append(conns, c)
+	}
+	for i := 0; i < 2; i++ {
+		c := newWeightedConn(fmt.Sprintf("http://failover%d:9200", i), 1, 1)
+		failovers = append(failovers, c)
+		conns = append(conns, c)
+	}
+	b, err := NewBalancer(conns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := b.(*Balancer).PanicThreshold(0.5)
+
+	get := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 12; i++ {
+			conn, err := balancer.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[conn.URL().Host]++
+		}
+		return counts
+	}
+
+	// The failovers are healthy enough: use them, without panic
+	if want, have := "map[failover0:9200:6 failover1:9200:6]", fmt.Sprint(get()); want != have {
+		t.Errorf("expected %s; got: %s", want, have)
+	}
+	if balancer.IsPanicking() {
+		t.Error("expected balancer to not be in panic mode")
+	}
+
+	// 1 of 4 primaries is healthy, which is not enough: use the failovers
+	primaries[0].broken = false
+	if want, have := "map[failover0:9200:6 failover1:9200:6]", fmt.Sprint(get()); want != have {
+		t.Errorf("expected %s; got: %s", want, have)
+	}
+
+	// No priority has enough healthy connections: panic within the
+	// primaries, which have healthy connections
+	failovers[0].broken = true
+	failovers[1].broken = true
+	if want, have := "map[primary0:9200:3 primary1:9200:3 primary2:9200:3 primary3:9200:3]", fmt.Sprint(get()); want != have {
+		t.Errorf("expected %s; got: %s", want, have)
+	}
+	if !balancer.IsPanicking() {
+		t.Error("expected balancer to be in panic mode")
+	}
+
+	// 2 of 4 primaries are healthy: leave panic mode
+	primaries[1].broken = false
+	if want, have := "map[primary0:9200:6 primary1:9200:6]", fmt.Sprint(get()); want != have {
+		t.Errorf("expected %s; got: %s", want, have)
+	}
+	if balancer.IsPanicking() {
+		t.Error("expected balancer to not be in panic mode")
+	}
+}
+
+func TestBalancerPanicThresholdWithAllConnectionsBroken(t *testing.T) {
+	b, err := NewBalancer(
+		newTestConn("http://127.0.0.1:12345", true),
+		newTestConn("http://127.0.0.1:23456", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+	b.(*Balancer).PanicThreshold(0.1)
+	if _, err := b.Get(); err != nil {
+		t.Fatalf("expected no error in panic mode; got: %v", err)
+	}
+}
+
 func TestBalancerRewritesSchemeAndURLButNotPathOrQuery(t *testing.T) {
 	var visited []string
 
@@ -220,3 +436,607 @@ func BenchmarkBalancer(b *testing.B) {
 		b.Fatalf("expected %d visits; got: %d", want, have)
 	}
 }
+
+func TestBalancerWithTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	balancer, err := NewBalancerFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+
+	balancer.Transport(server.Client().Transport)
+	if _, err := balancer.Get(); err != nil {
+		t.Fatalf("expected connection; got: %v", err)
+	}
+}
+
+func TestBalancerUsesBaseOfTransportForHealthChecks(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" { // health check
+			time.Sleep(delay)
+		}
+	})
+	var urls []string
+	var client *http.Client
+	for i := 0; i < 5; i++ {
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+		urls = append(urls, server.URL)
+		client = server.Client() // all servers share the same certificate
+	}
+
+	balancer, err := NewBalancerFromURL(urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	transport := balancers.NewTransport(balancer)
+	transport.Base = client.Transport
+
+	// The first request does not wait for the connections to be checked
+	start := time.Now()
+	res, err := (&http.Client{Transport: transport}).Get("http://example.com/api")
+	if err == nil {
+		res.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("expected first request to not wait for health checks; took %v", elapsed)
+	}
+
+	// The connections are checked concurrently in the background
+	deadline := time.Now().Add(2 * delay)
+	for {
+		broken := 0
+		for _, stats := range balancer.Stats() {
+			if stats.Broken {
+				broken++
+			}
+		}
+		if broken == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected connections to be checked concurrently; %d still broken", broken)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Connections added later are checked with the Base, too
+	u, _ := url.Parse(urls[0])
+	conn := balancers.NewHttpConnection(u)
+	if !conn.IsBroken() {
+		t.Fatal("expected connection with unknown certificate to be broken")
+	}
+	balancer.Add(conn)
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+}
+
+func TestBalancerSubscribe(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	balancer, err := NewBalancerFromURL(server.URL, "http://localhost:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []balancers.HealthEvent
+	unsubscribe := balancer.Subscribe(func(ev balancers.HealthEvent) {
+		events = append(events, ev)
+	})
+	defer unsubscribe()
+
+	status = http.StatusInternalServerError
+	balancer.conns[0].(*balancers.HttpConnection).HealthCheck(nil)
+	if len(events) != 1 {
+		t.Fatalf("expected %d events; got: %d", 1, len(events))
+	}
+	if want, have := server.URL, events[0].Conn.URL().String(); want != have {
+		t.Errorf("expected URL %q; got: %q", want, have)
+	}
+	if !events[0].Broken {
+		t.Error("expected connection to be broken")
+	}
+}
+
+func TestBalancerAddTwiceDoesNotLeakSubscriptions(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	conn := balancers.NewHttpConnection(u).HeartbeatDuration(0)
+	defer conn.Close()
+	b, _ := NewBalancer()
+	balancer := b.(*Balancer)
+	var events int
+	balancer.Subscribe(func(ev balancers.HealthEvent) {
+		events++
+	})
+
+	balancer.Add(conn)
+	balancer.Add(conn)
+	balancer.Remove(conn)
+	status = http.StatusInternalServerError
+	conn.HealthCheck(nil)
+	if events != 0 {
+		t.Errorf("expected %d events of a removed connection; got: %d", 0, events)
+	}
+}
+
+type closableConn struct {
+	testConn
+	closed bool
+}
+
+func (c *closableConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newClosableConn(rawurl string) *closableConn {
+	u, _ := url.Parse(rawurl)
+	return &closableConn{testConn: testConn{url: u}}
+}
+
+func urlsOf(conns []balancers.Connection) []string {
+	var urls []string
+	for _, c := range conns {
+		urls = append(urls, c.URL().String())
+	}
+	return urls
+}
+
+func TestBalancerAddAndRemove(t *testing.T) {
+	conn1 := newClosableConn("http://127.0.0.1:1")
+	conn2 := newClosableConn("http://127.0.0.1:2")
+	conn3 := newClosableConn("http://127.0.0.1:3")
+
+	b, err := NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := b.(*Balancer)
+
+	if conn, _ := balancer.Get(); conn != conn1 {
+		t.Fatalf("expected %v; got: %v", conn1.URL(), conn.URL())
+	}
+
+	// Adding a connection twice has no effect
+	balancer.Add(conn3, conn3)
+	balancer.Add(conn3)
+	if want, have := "[http://127.0.0.1:1 http://127.0.0.1:2 http://127.0.0.1:3]", fmt.Sprint(urlsOf(balancer.conns)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	// Connections are identified by pointer, not by URL
+	balancer.Remove(newClosableConn("http://127.0.0.1:1"))
+	if conn1.closed {
+		t.Error("expected connection with the same URL to not be removed")
+	}
+	balancer.Remove(conn1)
+	if !conn1.closed {
+		t.Error("expected removed connection to be closed")
+	}
+	if conn2.closed || conn3.closed {
+		t.Error("expected remaining connections to not be closed")
+	}
+	if want, have := "[http://127.0.0.1:2 http://127.0.0.1:3]", fmt.Sprint(urlsOf(balancer.conns)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+
+	// Round-robin continues with the connection after the removed one
+	for i, want := range []balancers.Connection{conn2, conn3, conn2} {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("%d: expected %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+
+	balancer.Remove(conn2, conn3)
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerReplace(t *testing.T) {
+	conn1 := newClosableConn("http://127.0.0.1:1")
+	conn2 := newClosableConn("http://127.0.0.1:2")
+	conn3 := newClosableConn("http://127.0.0.1:3")
+	conn4 := newClosableConn("http://127.0.0.1:4")
+
+	b, err := NewBalancer(conn1, conn2, conn3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := b.(*Balancer)
+	balancer.Get()
+
+	balancer.Replace(conn2, conn3, conn4)
+	if !conn1.closed {
+		t.Error("expected replaced connection to be closed")
+	}
+	if conn2.closed || conn3.closed || conn4.closed {
+		t.Error("expected current connections to not be closed")
+	}
+	if want, have := "[http://127.0.0.1:2 http://127.0.0.1:3 http://127.0.0.1:4]", fmt.Sprint(urlsOf(balancer.conns)); want != have {
+		t.Fatalf("expected %s; got: %s", want, have)
+	}
+	if conn, _ := balancer.Get(); conn != conn2 {
+		t.Errorf("expected %v; got: %v", conn2.URL(), conn.URL())
+	}
+
+	balancer.Replace()
+	if !conn2.closed || !conn3.closed || !conn4.closed {
+		t.Error("expected all connections to be closed")
+	}
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerReplaceStopsHeartbeats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	clock := clocktest.NewClock(time.Now())
+	scheduler := balancers.NewScheduler().Clock(clock)
+	u, _ := url.Parse(server.URL)
+	conn := balancers.NewHttpConnection(u).Scheduler(scheduler)
+	balancer, err := NewBalancer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock.Timers() != 1 {
+		t.Fatalf("expected %d heartbeat; got: %d", 1, clock.Timers())
+	}
+
+	balancer.(*Balancer).Replace()
+	if clock.Timers() != 0 {
+		t.Fatalf("expected %d heartbeats; got: %d", 0, clock.Timers())
+	}
+}
+
+type drainingConn struct {
+	testConn
+	draining bool
+}
+
+func (c *drainingConn) IsDraining() bool { return c.draining }
+
+func TestBalancerSkipsDrainingConnections(t *testing.T) {
+	conn1 := &drainingConn{testConn: *newTestConn("http://127.0.0.1:1", false)}
+	conn2 := &drainingConn{testConn: *newTestConn("http://127.0.0.1:2", false)}
+
+	balancer, err := NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn1.draining = true
+	for i := 0; i < 3; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != conn2 {
+			t.Errorf("%d: expected %v; got: %v", i, conn2.URL(), conn.URL())
+		}
+	}
+
+	// Draining connections are not used in panic mode either
+	conn2.draining = true
+	balancer.(*Balancer).PanicThreshold(1)
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	var list []*Balancer
+	for i := 0; i < 10; i++ {
+		balancer, err := NewBalancerFromURL(server.URL, server.URL, "http://localhost:12345")
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, balancer)
+	}
+
+	// Run slow heartbeats frequently to have checks in flight while closing
+	scheduler := balancers.NewScheduler()
+	for _, balancer := range list {
+		for _, c := range balancer.conns {
+			c.(*balancers.HttpConnection).Scheduler(scheduler).HeartbeatDuration(time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for _, balancer := range list {
+		if err := balancer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := balancer.Get(); err != balancers.ErrNoConn {
+			t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+		}
+	}
+	checkGoroutineLeaks(t)
+}
+
+func TestBalancerCloseStopsHeartbeats(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	scheduler := balancers.NewScheduler().Clock(clock)
+
+	var conns []balancers.Connection
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://localhost:%d", 12345+i))
+		conns = append(conns, balancers.NewHttpConnection(u).Scheduler(scheduler))
+	}
+	balancer, err := NewBalancer(conns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock.Timers() != 3 {
+		t.Fatalf("expected %d heartbeats; got: %d", 3, clock.Timers())
+	}
+	if err := balancers.Close(balancer); err != nil {
+		t.Fatal(err)
+	}
+	if clock.Timers() != 0 {
+		t.Fatalf("expected %d heartbeats; got: %d", 0, clock.Timers())
+	}
+}
+
+type weightedConn struct {
+	testConn
+	weight   int
+	priority int
+}
+
+func (c *weightedConn) Weight() int   { return c.weight }
+func (c *weightedConn) Priority() int { return c.priority }
+
+func newWeightedConn(rawurl string, weight, priority int) *weightedConn {
+	return &weightedConn{testConn: *newTestConn(rawurl, false), weight: weight, priority: priority}
+}
+
+func TestBalancerWithWeights(t *testing.T) {
+	conn1 := newWeightedConn("http://127.0.0.1:1", 3, 0)
+	conn2 := newWeightedConn("http://127.0.0.1:2", 1, 0)
+	conn3 := newWeightedConn("http://127.0.0.1:3", 2, 0)
+
+	balancer, err := NewBalancer(conn1, conn2, conn3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []balancers.Connection{conn1, conn3, conn1, conn2, conn3, conn1, conn1}
+	for i, want := range want {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("%d: expected %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+}
+
+func TestBalancerInterleavesWeightedConnections(t *testing.T) {
+	heavy := newWeightedConn("http://127.0.0.1:1", 5, 0)
+	light1 := newWeightedConn("http://127.0.0.1:2", 1, 0)
+	light2 := newWeightedConn("http://127.0.0.1:3", 1, 0)
+
+	balancer, err := NewBalancer(heavy, light1, light2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []balancers.Connection{heavy, heavy, light1, heavy, light2, heavy, heavy}
+	for round := 0; round < 3; round++ {
+		for i, want := range want {
+			conn, err := balancer.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn != want {
+				t.Errorf("%d/%d: expected %v; got: %v", round, i, want.URL(), conn.URL())
+			}
+		}
+	}
+
+	// High weights, e.g. from SRV records, do not result in bursts
+	conn1 := newWeightedConn("http://127.0.0.1:1", 65535, 0)
+	conn2 := newWeightedConn("http://127.0.0.1:2", 65535, 0)
+	balancer, err = NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last balancers.Connection
+	for i := 0; i < 1000; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn == last {
+			t.Fatalf("%d: expected requests to alternate; got %v twice in a row", i, conn.URL())
+		}
+		last = conn
+	}
+}
+
+func TestBalancerWithPriorities(t *testing.T) {
+	primary1 := newWeightedConn("http://127.0.0.1:1", 1, 0)
+	primary2 := newWeightedConn("http://127.0.0.1:2", 1, 0)
+	backup := newWeightedConn("http://127.0.0.1:3", 1, 10)
+
+	balancer, err := NewBalancer(backup, primary1, primary2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []balancers.Connection{primary1, primary2, primary1} {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("%d: expected %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+
+	// Fail over to the backup tier
+	primary1.broken = true
+	primary2.broken = true
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != backup {
+			t.Errorf("%d: expected %v; got: %v", i, backup.URL(), conn.URL())
+		}
+	}
+
+	// Fail back
+	primary2.broken = false
+	if conn, _ := balancer.Get(); conn != primary2 {
+		t.Errorf("expected %v; got: %v", primary2.URL(), conn.URL())
+	}
+}
+
+func TestBalancerFromRegistry(t *testing.T) {
+	conn1 := newTestConn("http://127.0.0.1:12345", true)
+	conn2 := newTestConn("http://127.0.0.1:23456", true)
+	b, err := balancers.New("roundrobin", balancers.Options{
+		Connections:    []balancers.Connection{conn1, conn2},
+		PanicThreshold: 0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All connections are broken, so the balancer panics
+	conn, err := b.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != conn1 {
+		t.Errorf("expected %v; got: %v", conn1.URL(), conn.URL())
+	}
+
+	_, err = balancers.New("roundrobin", balancers.Options{Params: map[string]string{"choices": "2"}})
+	if err == nil {
+		t.Fatal("expected error for unknown param")
+	}
+}
+
+func TestBalancerFromURLWithOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	balancer, err := NewBalancerFromURL(server.URL+"?weight=2&health=/healthz", server.URL+"/b?health=/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+
+	var urls []string
+	for i := 0; i < 3; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, conn.URL().String())
+	}
+	if want, have := fmt.Sprint([]string{server.URL, server.URL + "/b", server.URL}), fmt.Sprint(urls); want != have {
+		t.Errorf("expected %s; got: %s", want, have)
+	}
+
+	if _, err := NewBalancerFromURL(server.URL, server.URL+"?weight=heavy"); err == nil {
+		t.Fatal("expected error for invalid weight")
+	}
+}
+
+func TestBalancerStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	conn1 := balancers.NewHttpConnection(u)
+	defer conn1.Close()
+	conn2 := newTestConn("http://127.0.0.1:12345", true)
+	balancer, err := NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := balancers.NewClient(balancer)
+	res, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	stats := balancer.(*Balancer).Stats()
+	if want, have := 2, len(stats); want != have {
+		t.Fatalf("expected %d stats; got: %d", want, have)
+	}
+	if stats[0].URL != server.URL || stats[0].Broken || stats[0].Requests != 1 {
+		t.Errorf("unexpected stats %+v", stats[0])
+	}
+	if stats[1].URL != "http://127.0.0.1:12345" || !stats[1].Broken || stats[1].Requests != 0 {
+		t.Errorf("unexpected stats %+v", stats[1])
+	}
+}
+
+func TestBalancerLogger(t *testing.T) {
+	conn := newTestConn("http://127.0.0.1:12345", true)
+	b, err := NewBalancer(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	balancer := b.(*Balancer).PanicThreshold(0.5).Logger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	balancer.Get()
+	conn.broken = false
+	balancer.Get()
+	conn.broken = true
+	balancer.PanicThreshold(0).Get()
+
+	want := []string{
+		`level=WARN msg="panic mode entered" healthy=0 total=1`,
+		`level=INFO msg="panic mode left" healthy=1 total=1`,
+		`level=WARN msg="no connection" error="no connection" cause=no_connection healthy=0 total=1`,
+	}
+	if have := strings.TrimSpace(buf.String()); have != strings.Join(want, "\n") {
+		t.Errorf("expected log\n%s\ngot:\n%s", strings.Join(want, "\n"), have)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package roundrobin
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leakedGoroutines returns the stacks of all goroutines that run code
+// of the balancers packages, except for tests and HTTP handlers.
+func leakedGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		switch {
+		case !strings.Contains(g, "github.com/olivere/balancers"):
+		case strings.Contains(g, "testing.tRunner"):
+		case strings.Contains(g, "net/http.(*conn).serve"):
+		default:
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
+
+// checkGoroutineLeaks fails the test if goroutines of the balancers
+// packages are still running after a grace period.
+func checkGoroutineLeaks(t *testing.T) {
+	var leaked []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if leaked = leakedGoroutines(); len(leaked) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("found %d leaked goroutines:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+}
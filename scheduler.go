@@ -0,0 +1,293 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultScheduler is the Scheduler used by connections unless
+// configured otherwise.
+var DefaultScheduler = NewScheduler()
+
+// Scheduler runs the heartbeats of connections. Instead of running a
+// goroutine and a ticker per connection, a Scheduler uses a timer per
+// distinct check and runs the checks on a bounded pool of workers.
+// Workers are only running while there are checks to perform.
+//
+// Every interval is randomized by a jitter so that the checks of
+// connections created at the same time do not fire in sync.
+//
+// Connections that check the same URL with the same Checker, transport
+// and heartbeat duration share a single check, even if they belong to
+// different balancers. For this to work, the Checker and the transport
+// must be pointers; other checks are never shared.
+type Scheduler struct {
+	mu        sync.Mutex // guards the following variables
+	idle      *sync.Cond // signaled when the last worker finishes
+	clock     Clock
+	workers   int     // maximum number of concurrent checks
+	jitter    float64 // fraction of the interval to randomize by
+	observers []Observer
+	targets   map[targetKey]*target
+	pending   []*target // checks waiting for a worker
+	active    int       // number of running workers
+	nextID    uint64    // used to create unique keys
+}
+
+// targetKey identifies a check.
+type targetKey struct {
+	url       string
+	checker   Checker
+	transport http.RoundTripper
+	interval  time.Duration
+	id        uint64 // non-zero for checkers that cannot be shared
+}
+
+// target is a check that is run periodically on behalf of one or
+// more subscriptions.
+type target struct {
+	key      targetKey
+	url      *url.URL
+	checker  Checker
+	interval time.Duration
+	subs     map[*subscription]struct{}
+	timer    Timer
+	stopped  bool
+}
+
+// subscription receives the results of a target.
+type subscription struct {
+	target *target
+	fn     func(err error)
+}
+
+// NewScheduler creates a new Scheduler with DefaultSchedulerWorkers
+// workers and a jitter of DefaultHeartbeatJitter.
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		clock:   RealClock,
+		workers: DefaultSchedulerWorkers,
+		jitter:  DefaultHeartbeatJitter,
+		targets: make(map[targetKey]*target),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// Clock sets the Clock used to schedule checks. It also serves as the
+// source of time for connections using this Scheduler. Set the clock
+// before any connection uses the Scheduler.
+func (s *Scheduler) Clock(clock Clock) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if clock == nil {
+		clock = RealClock
+	}
+	s.clock = clock
+	return s
+}
+
+// Wait blocks until all checks that are due have been performed.
+// It is mostly useful in tests with a fake Clock.
+func (s *Scheduler) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.active > 0 || len(s.pending) > 0 {
+		s.idle.Wait()
+	}
+}
+
+// now returns the current time of the clock.
+func (s *Scheduler) now() time.Time {
+	return s.getClock().Now()
+}
+
+// getClock returns the clock of the scheduler.
+func (s *Scheduler) getClock() Clock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clock
+}
+
+// Observer adds an Observer that is notified about every health check
+// run by the Scheduler, including the initial checks of connections.
+// The Scheduler may be shared by several balancers, e.g. DefaultScheduler,
+// so an Observer is notified about the checks of all of them.
+func (s *Scheduler) Observer(o Observer) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o != nil {
+		s.observers = append(s.observers, o)
+	}
+	return s
+}
+
+// check checks u with checker and notifies the observers, if any.
+func (s *Scheduler) check(u *url.URL, checker Checker) error {
+	clock := s.getClock()
+	start := clock.Now()
+	err := checker.Check(context.Background(), u)
+	elapsed := clock.Now().Sub(start)
+	s.mu.Lock()
+	observers := s.observers
+	s.mu.Unlock()
+	for _, o := range observers {
+		o.HealthChecked(u, err, elapsed)
+	}
+	return err
+}
+
+// Workers sets the maximum number of checks that run concurrently.
+func (s *Scheduler) Workers(n int) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	s.workers = n
+	return s
+}
+
+// Jitter sets the fraction by which each interval is randomized,
+// e.g. 0.1 runs a check with a heartbeat duration of 30s every 27s to 33s.
+func (s *Scheduler) Jitter(fraction float64) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	s.jitter = fraction
+	return s
+}
+
+// subscribe registers fn to be called with the result of checking u with
+// checker every interval. A *HealthCheck without a Transport of its own
+// sends its requests with transport, if set. Use unsubscribe to stop.
+func (s *Scheduler) subscribe(u *url.URL, checker Checker, transport http.RoundTripper, interval time.Duration, fn func(err error)) *subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := targetKey{url: u.String(), interval: interval}
+	if isPointer(checker) && (transport == nil || isPointer(transport)) {
+		key.checker, key.transport = checker, transport
+	} else {
+		s.nextID++
+		key.id = s.nextID
+	}
+
+	t, found := s.targets[key]
+	if !found {
+		t = &target{
+			key:      key,
+			url:      u,
+			checker:  withTransport(checker, transport),
+			interval: interval,
+			subs:     make(map[*subscription]struct{}),
+		}
+		s.targets[key] = t
+		s.scheduleLocked(t)
+	}
+	sub := &subscription{target: t, fn: fn}
+	t.subs[sub] = struct{}{}
+	return sub
+}
+
+// isPointer returns true if v is a pointer. Pointers can be compared
+// safely, unlike e.g. structs that may contain functions.
+func isPointer(v interface{}) bool {
+	return reflect.TypeOf(v).Kind() == reflect.Ptr
+}
+
+// unsubscribe stops delivering results to sub. The check is stopped when
+// its last subscription is removed.
+func (s *Scheduler) unsubscribe(sub *subscription) {
+	if sub == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := sub.target
+	delete(t.subs, sub)
+	if len(t.subs) == 0 && !t.stopped {
+		t.stopped = true
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		delete(s.targets, t.key)
+	}
+}
+
+// scheduleLocked arms the timer of t. The caller must hold the lock.
+func (s *Scheduler) scheduleLocked(t *target) {
+	t.timer = s.clock.AfterFunc(s.delayLocked(t.interval), func() { s.enqueue(t) })
+}
+
+// delayLocked returns interval randomized by the jitter.
+// The caller must hold the lock.
+func (s *Scheduler) delayLocked(interval time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*s.jitter*float64(interval))
+}
+
+// enqueue queues t for execution and starts a worker if possible.
+func (s *Scheduler) enqueue(t *target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	s.pending = append(s.pending, t)
+	if s.active < s.workers {
+		s.active++
+		go s.work()
+	}
+}
+
+// work runs pending checks until there are none left.
+func (s *Scheduler) work() {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.active--
+			if s.active == 0 {
+				s.idle.Broadcast()
+			}
+			s.mu.Unlock()
+			return
+		}
+		t := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		err := s.check(t.url, t.checker)
+
+		s.mu.Lock()
+		fns := make([]func(error), 0, len(t.subs))
+		for sub := range t.subs {
+			fns = append(fns, sub.fn)
+		}
+		if !t.stopped {
+			s.scheduleLocked(t)
+		}
+		s.mu.Unlock()
+
+		for _, fn := range fns {
+			fn(err)
+		}
+	}
+}
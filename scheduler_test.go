@@ -0,0 +1,185 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerDeduplicatesChecks(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}))
+	defer server.Close()
+
+	s := NewScheduler().Jitter(0)
+	url1, _ := url.Parse(server.URL)
+	url2, _ := url.Parse(server.URL)
+	conn1 := NewHttpConnection(url1).Scheduler(s).HeartbeatDuration(200 * time.Millisecond)
+	conn2 := NewHttpConnection(url2).Scheduler(s).HeartbeatDuration(200 * time.Millisecond)
+
+	s.mu.Lock()
+	targets := len(s.targets)
+	s.mu.Unlock()
+	if targets != 1 {
+		t.Errorf("expected %d check; got: %d", 1, targets)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	conn1.Close()
+	conn2.Close()
+
+	if have := atomic.LoadInt64(&count); have != 3 { // 2 on NewHttpConnection + 1 shared heartbeat
+		t.Errorf("expected %d requests; got: %d", 3, have)
+	}
+
+	s.mu.Lock()
+	targets = len(s.targets)
+	s.mu.Unlock()
+	if targets != 0 {
+		t.Errorf("expected %d checks; got: %d", 0, targets)
+	}
+}
+
+func TestSchedulerDeduplicatesChecksWithTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	s := NewScheduler().Jitter(0)
+	transport := server.Client().Transport
+	checker := &HealthCheck{Path: "/healthz"}
+	var conns []*HttpConnection
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(server.URL)
+		conn := NewHttpConnection(u).Scheduler(s).HealthCheck(checker).Transport(transport)
+		defer conn.Close()
+		if conn.IsBroken() {
+			t.Fatalf("#%d: expected connection to not be broken", i)
+		}
+		conns = append(conns, conn)
+	}
+
+	s.mu.Lock()
+	targets := len(s.targets)
+	s.mu.Unlock()
+	if targets != 1 {
+		t.Errorf("expected %d check; got: %d", 1, targets)
+	}
+
+	// Another transport needs a check of its own
+	conns[0].Transport(http.DefaultTransport)
+	s.mu.Lock()
+	targets = len(s.targets)
+	s.mu.Unlock()
+	if targets != 2 {
+		t.Errorf("expected %d checks; got: %d", 2, targets)
+	}
+}
+
+// wrappingChecker is a comparable type whose values may not be, e.g. if
+// Inner is a CheckerFunc.
+type wrappingChecker struct {
+	Inner Checker
+}
+
+func (c wrappingChecker) Check(ctx context.Context, u *url.URL) error {
+	return c.Inner.Check(ctx, u)
+}
+
+func TestSchedulerWithUnhashableChecker(t *testing.T) {
+	s := NewScheduler().Jitter(0)
+	u, _ := url.Parse("http://127.0.0.1:12345")
+	checker := wrappingChecker{Inner: CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		return nil
+	})}
+	conn1 := NewHttpConnection(u).Scheduler(s).Checker(checker)
+	defer conn1.Close()
+	conn2 := NewHttpConnection(u).Scheduler(s).Checker(checker)
+	defer conn2.Close()
+
+	if conn1.IsBroken() || conn2.IsBroken() {
+		t.Error("expected connections to not be broken")
+	}
+	s.mu.Lock()
+	targets := len(s.targets)
+	s.mu.Unlock()
+	if targets != 2 {
+		t.Errorf("expected %d checks; got: %d", 2, targets)
+	}
+}
+
+func TestSchedulerLimitsWorkers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		maxRun  int
+		total   int
+	)
+	checker := CheckerFunc(func(ctx context.Context, u *url.URL) error {
+		mu.Lock()
+		running++
+		total++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	s := NewScheduler().Workers(2).Jitter(0)
+	var subs []*subscription
+	for i := 0; i < 10; i++ {
+		u, _ := url.Parse("http://127.0.0.1:12345")
+		// CheckerFunc is not comparable, so every subscription gets its own check
+		subs = append(subs, s.subscribe(u, checker, nil, 10*time.Millisecond, func(error) {}))
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, sub := range subs {
+		s.unsubscribe(sub)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if total < 10 {
+		t.Errorf("expected at least %d checks; got: %d", 10, total)
+	}
+	if maxRun > 2 {
+		t.Errorf("expected at most %d concurrent checks; got: %d", 2, maxRun)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	s := NewScheduler().Jitter(0.1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := s.delayLocked(10 * time.Second)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("expected delay between %v and %v; got: %v", 9*time.Second, 11*time.Second, d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("expected delays to be randomized")
+	}
+
+	s.jitter = 0
+	if d := s.delayLocked(10 * time.Second); d != 10*time.Second {
+		t.Errorf("expected delay %v; got: %v", 10*time.Second, d)
+	}
+}
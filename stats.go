@@ -0,0 +1,143 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"expvar"
+	"sort"
+	"time"
+)
+
+// latencyWindow is the number of recent requests whose latencies are
+// used to compute percentiles.
+const latencyWindow = 1024
+
+// ConnectionStats is a snapshot of the state and the requests of a
+// connection. Fields that a connection does not support are zero.
+type ConnectionStats struct {
+	URL                  string       `json:"url"`
+	Broken               bool         `json:"broken"`
+	Draining             bool         `json:"draining"`
+	Weight               int          `json:"weight"`
+	Priority             int          `json:"priority"`
+	ConsecutiveSuccesses int          `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int          `json:"consecutiveFailures"`
+	LastCheck            time.Time    `json:"lastCheck"`
+	LastError            string       `json:"lastError,omitempty"`
+	Requests             uint64       `json:"requests"` // requests served, not counting Errors
+	Errors               uint64       `json:"errors"`   // requests failed or answered with 5xx
+	InFlight             int          `json:"inFlight"`
+	Latency              LatencyStats `json:"latency"`
+}
+
+// LatencyStats are percentiles of the time until the response headers of
+// the recent requests of a connection arrived. They are encoded in JSON
+// as nanoseconds.
+type LatencyStats struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// RequestRecorder is implemented by connections that keep statistics
+// about their requests. Transport calls RecordRequest when the response
+// headers of a request arrive or the request fails.
+type RequestRecorder interface {
+	RecordRequest(statusCode int, err error, elapsed time.Duration)
+}
+
+// StatsProvider is implemented by connections that report their stats.
+type StatsProvider interface {
+	Stats() ConnectionStats
+}
+
+// StatsReporter is implemented by balancers that report the stats of
+// their connections.
+type StatsReporter interface {
+	Stats() []ConnectionStats
+}
+
+// StatsOf returns the stats of conn. For connections that do not
+// implement StatsProvider, only the fields available through the
+// Connection interface and the optional interfaces are set.
+func StatsOf(conn Connection) ConnectionStats {
+	if p, ok := conn.(StatsProvider); ok {
+		return p.Stats()
+	}
+	stats := ConnectionStats{
+		URL:    conn.URL().Redacted(),
+		Broken: conn.IsBroken(),
+		Weight: 1,
+	}
+	if d, ok := conn.(Drainer); ok {
+		stats.Draining = d.IsDraining()
+	}
+	if w, ok := conn.(Weighted); ok {
+		stats.Weight = w.Weight()
+	}
+	if p, ok := conn.(Prioritized); ok {
+		stats.Priority = p.Priority()
+	}
+	return stats
+}
+
+// PublishStats publishes the stats of a balancer as an expvar variable
+// with the given name, e.g. to be served on /debug/vars. Like
+// expvar.Publish, it panics if the name is already in use.
+func PublishStats(name string, r StatsReporter) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Stats()
+	}))
+}
+
+// requestStats records the requests of a connection.
+type requestStats struct {
+	requests  uint64
+	errors    uint64
+	latencies []time.Duration // ring buffer of recent latencies
+	next      int             // index of the next latency to replace
+}
+
+// record records a request.
+func (s *requestStats) record(statusCode int, err error, elapsed time.Duration) {
+	if err != nil || statusCode >= 500 {
+		s.errors++
+	} else {
+		s.requests++
+	}
+	if len(s.latencies) < latencyWindow {
+		s.latencies = append(s.latencies, elapsed)
+		return
+	}
+	s.latencies[s.next] = elapsed
+	s.next = (s.next + 1) % latencyWindow
+}
+
+// window returns a copy of the recent latencies.
+func (s *requestStats) window() []time.Duration {
+	return append([]time.Duration(nil), s.latencies...)
+}
+
+// latencyOf computes the percentiles of latencies, which it sorts.
+// Sort a copy returned by window outside of the lock that guards the
+// stats, so that recording requests is not blocked meanwhile.
+func latencyOf(latencies []time.Duration) LatencyStats {
+	if len(latencies) == 0 {
+		return LatencyStats{}
+	}
+	sorted := latencies
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		// Nearest rank
+		rank := (p*len(sorted) + 99) / 100
+		return sorted[rank-1]
+	}
+	return LatencyStats{
+		P50: percentile(50),
+		P90: percentile(90),
+		P99: percentile(99),
+		Max: sorted[len(sorted)-1],
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestStatsLatency(t *testing.T) {
+	var s requestStats
+	if want, have := (LatencyStats{}), latencyOf(s.window()); want != have {
+		t.Errorf("expected %+v; got: %+v", want, have)
+	}
+	for i := 100; i >= 1; i-- {
+		s.record(200, nil, time.Duration(i)*time.Millisecond)
+	}
+	want := LatencyStats{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if have := latencyOf(s.window()); want != have {
+		t.Errorf("expected %+v; got: %+v", want, have)
+	}
+
+	// Only the most recent latencies are used
+	for i := 0; i < latencyWindow; i++ {
+		s.record(200, nil, time.Second)
+	}
+	want = LatencyStats{P50: time.Second, P90: time.Second, P99: time.Second, Max: time.Second}
+	if have := latencyOf(s.window()); want != have {
+		t.Errorf("expected %+v; got: %+v", want, have)
+	}
+	if want, have := uint64(100+latencyWindow), s.requests; want != have {
+		t.Errorf("expected %d requests; got: %d", want, have)
+	}
+}
+
+func TestHttpConnectionStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "secret")
+	conn := NewHttpConnection(u)
+	defer conn.Close()
+	conn.SetWeight(2)
+
+	client := NewClient(&testBalancer{conn: conn})
+	for _, path := range []string{"/", "/fail", "/"} {
+		res, err := client.Get("http://example.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	conn.RecordRequest(0, errors.New("connection refused"), time.Second)
+
+	stats := conn.Stats()
+	if want, have := u.Redacted(), stats.URL; want != have {
+		t.Errorf("expected URL %q; got: %q", want, have)
+	}
+	if stats.Broken || stats.Weight != 2 || stats.InFlight != 0 || stats.LastCheck.IsZero() {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if want, have := uint64(2), stats.Requests; want != have {
+		t.Errorf("expected %d requests; got: %d", want, have)
+	}
+	if want, have := uint64(2), stats.Errors; want != have {
+		t.Errorf("expected %d errors; got: %d", want, have)
+	}
+	if want, have := time.Second, stats.Latency.Max; want != have {
+		t.Errorf("expected max latency %v; got: %v", want, have)
+	}
+}
+
+// statsConn only implements the optional Weighted interface.
+type statsConn struct {
+	url *url.URL
+}
+
+func (c *statsConn) URL() *url.URL  { return c.url }
+func (c *statsConn) IsBroken() bool { return true }
+func (c *statsConn) Weight() int    { return 3 }
+
+func TestStatsOf(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	want := ConnectionStats{URL: "http://127.0.0.1:9200", Broken: true, Weight: 3}
+	if have := StatsOf(&statsConn{url: u}); want != have {
+		t.Errorf("expected %+v; got: %+v", want, have)
+	}
+}
+
+// statsReporter reports fixed stats.
+type statsReporter []ConnectionStats
+
+func (r statsReporter) Stats() []ConnectionStats { return r }
+
+// publishedStats numbers the variables published by tests, since
+// expvar.Publish panics if a name is reused, e.g. with -count.
+var publishedStats int64
+
+func TestPublishStats(t *testing.T) {
+	name := fmt.Sprintf("balancers_test_%d", atomic.AddInt64(&publishedStats, 1))
+	PublishStats(name, statsReporter{{URL: "http://127.0.0.1:9200", Requests: 7}})
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("expected variable to be published")
+	}
+	var stats []ConnectionStats
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Requests != 7 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
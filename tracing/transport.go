@@ -0,0 +1,233 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+/*
+Package tracing traces the requests of a balancers.Transport with
+OpenTelemetry.
+
+Use a Transport of this package as the Base of a balancers.Transport:
+
+	transport := balancers.NewTransport(balancer)
+	transport.Base = tracing.NewTransport(nil, tracing.Options{})
+	client := &http.Client{Transport: transport}
+
+Every attempt to send a request then results in a client span with the
+backend chosen by the balancer and the reasons for the choice, e.g. the
+health of the backend and whether the balancer is in panic mode. The
+span of an attempt ends when the body of the response is read or closed,
+so it includes the transfer of the body. The trace context is propagated
+to the backend in the W3C traceparent header.
+
+Requests that are not sent by a balancers.Transport, e.g. the health
+checks that a balancer sends with the Base of its Transport, are passed
+to the underlying RoundTripper without tracing.
+
+The package is a module of its own, so that only programs that use it
+depend on OpenTelemetry.
+*/
+package tracing
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/olivere/balancers"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer.
+const instrumentationName = "github.com/olivere/balancers/tracing"
+
+// Options configure a Transport.
+type Options struct {
+	// TracerProvider creates the tracer. It defaults to the global
+	// TracerProvider.
+	TracerProvider trace.TracerProvider
+
+	// Propagator injects the trace context into requests. It defaults
+	// to the W3C trace context propagator.
+	Propagator propagation.TextMapPropagator
+
+	// Annotate adds an event with the attributes of every attempt to the
+	// span in the context of the request, e.g. a span created by the
+	// caller, instead of creating a span per attempt.
+	Annotate bool
+}
+
+// Transport is a http.RoundTripper that traces requests.
+type Transport struct {
+	base       http.RoundTripper
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	annotate   bool
+}
+
+// NewTransport creates a Transport that sends requests with base. If base
+// is nil, http.DefaultTransport is used.
+func NewTransport(base http.RoundTripper, opts Options) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = otel.GetTracerProvider()
+	}
+	if opts.Propagator == nil {
+		opts.Propagator = propagation.TraceContext{}
+	}
+	return &Transport{
+		base:       base,
+		tracer:     opts.TracerProvider.Tracer(instrumentationName),
+		propagator: opts.Propagator,
+		annotate:   opts.Annotate,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	info, ok := balancers.RequestInfoFromContext(ctx)
+	if !ok {
+		// Not sent by a balancers.Transport, e.g. a health check
+		return t.base.RoundTrip(r)
+	}
+	attrs := attributes(r, info)
+
+	var span trace.Span
+	if t.annotate {
+		span = trace.SpanFromContext(ctx)
+		span.AddEvent("balancers.attempt", trace.WithAttributes(attrs...))
+	} else {
+		ctx, span = t.tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrs...),
+		)
+	}
+	r = r.Clone(ctx)
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	res, err := t.base.RoundTrip(r)
+	if t.annotate {
+		if err != nil {
+			span.AddEvent("balancers.error", trace.WithAttributes(attribute.String("error.message", err.Error())))
+		}
+		return res, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return res, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+	// End the span when the body is read or closed, like otelhttp
+	body := &spanBody{rc: res.Body, span: span}
+	if rwc, ok := res.Body.(io.ReadWriteCloser); ok {
+		res.Body = &spanReadWriteBody{spanBody: body, w: rwc}
+	} else {
+		res.Body = body
+	}
+	return res, nil
+}
+
+// spanBody ends a span when the body of a response is read completely,
+// reading it fails, or it is closed.
+type spanBody struct {
+	rc   io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	switch {
+	case err == io.EOF:
+		b.end()
+	case err != nil:
+		b.span.RecordError(err)
+		b.span.SetStatus(codes.Error, err.Error())
+		b.end()
+	}
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.rc.Close()
+	b.end()
+	return err
+}
+
+func (b *spanBody) end() {
+	b.once.Do(func() { b.span.End() })
+}
+
+// spanReadWriteBody is a spanBody of a response whose body is writable,
+// e.g. after switching protocols.
+type spanReadWriteBody struct {
+	*spanBody
+	w io.Writer
+}
+
+func (b *spanReadWriteBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// attributes returns the attributes of an attempt to send r.
+func attributes(r *http.Request, info *balancers.RequestInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.full", r.URL.Redacted()),
+	}
+	if host, port, err := net.SplitHostPort(r.URL.Host); err == nil {
+		attrs = append(attrs, attribute.String("server.address", host))
+		if n, err := strconv.Atoi(port); err == nil {
+			attrs = append(attrs, attribute.Int("server.port", n))
+		}
+	} else {
+		attrs = append(attrs, attribute.String("server.address", r.URL.Host))
+	}
+
+	conn := info.Conn
+	attrs = append(attrs,
+		attribute.String("balancers.backend", conn.URL().Redacted()),
+		attribute.Int("balancers.attempt", info.Attempt),
+		attribute.Int("balancers.retries", info.Retries),
+		attribute.Bool("balancers.backend.broken", conn.IsBroken()),
+	)
+	if d, ok := conn.(balancers.Drainer); ok {
+		attrs = append(attrs, attribute.Bool("balancers.backend.draining", d.IsDraining()))
+	}
+	if w, ok := conn.(balancers.Weighted); ok {
+		attrs = append(attrs, attribute.Int("balancers.backend.weight", w.Weight()))
+	}
+	if p, ok := conn.(balancers.Prioritized); ok {
+		attrs = append(attrs, attribute.Int("balancers.backend.priority", p.Priority()))
+	}
+	if s, ok := conn.(interface {
+		State() balancers.ConnectionState
+	}); ok {
+		attrs = append(attrs, attribute.Int("balancers.backend.consecutive_failures", s.State().ConsecutiveFailures))
+	}
+
+	if n, ok := info.Balancer.(balancers.Named); ok {
+		attrs = append(attrs, attribute.String("balancers.algorithm", n.Algorithm()))
+	}
+	if state := info.State; state != nil {
+		attrs = append(attrs,
+			attribute.Bool("balancers.panicking", state.Panicking),
+			attribute.Int("balancers.backends.healthy", state.Healthy),
+			attribute.Int("balancers.backends.total", state.Total),
+		)
+	}
+	return attrs
+}
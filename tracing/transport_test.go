@@ -0,0 +1,201 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package tracing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/olivere/balancers"
+	"github.com/olivere/balancers/roundrobin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestBalancer returns a balancer whose first connection passes TCP
+// health checks but hangs up on requests, and whose second connection
+// is served by handler.
+func newTestBalancer(t *testing.T, handler http.Handler) (*roundrobin.Balancer, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	server := httptest.NewServer(handler)
+
+	u1, _ := url.Parse("http://" + ln.Addr().String())
+	u2, _ := url.Parse(server.URL)
+	conn1 := balancers.NewHttpConnection(u1).Checker(&balancers.TCPChecker{})
+	conn2 := balancers.NewHttpConnection(u2).Checker(&balancers.TCPChecker{})
+	b, err := balancers.New("roundrobin", balancers.Options{Connections: []balancers.Connection{conn1, conn2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*roundrobin.Balancer), func() {
+		b.(*roundrobin.Balancer).Close()
+		server.Close()
+		ln.Close()
+	}
+}
+
+func attributesOf(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestTransport(t *testing.T) {
+	var traceparent string
+	balancer, cleanup := newTestBalancer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer cleanup()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	transport := balancers.NewTransport(balancer)
+	transport.Retries = 1
+	transport.Base = NewTransport(nil, Options{TracerProvider: provider})
+	client := &http.Client{Transport: transport}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	req, _ := http.NewRequest("GET", "http://example.com/search", nil)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The span of the second attempt ends with the body
+	if want, have := 1, len(exporter.GetSpans()); want != have {
+		t.Fatalf("expected %d span before reading the body; got: %d", want, have)
+	}
+	res.Body.Close()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if want, have := 3, len(spans); want != have {
+		t.Fatalf("expected %d spans; got: %d", want, have)
+	}
+	traceID := parent.SpanContext().TraceID()
+	for i, span := range spans[:2] {
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("expected span %d to be a child of the parent span", i)
+		}
+		attrs := attributesOf(span.Attributes)
+		if want, have := int64(i+1), attrs["balancers.attempt"].AsInt64(); want != have {
+			t.Errorf("expected attempt %d; got: %d", want, have)
+		}
+		if want, have := int64(1), attrs["balancers.retries"].AsInt64(); want != have {
+			t.Errorf("expected %d retries; got: %d", want, have)
+		}
+		if want, have := "roundrobin", attrs["balancers.algorithm"].AsString(); want != have {
+			t.Errorf("expected algorithm %q; got: %q", want, have)
+		}
+		if attrs["balancers.backend.broken"].AsBool() || attrs["balancers.panicking"].AsBool() {
+			t.Errorf("expected healthy backend and no panic mode")
+		}
+		if want, have := int64(2), attrs["balancers.backends.healthy"].AsInt64(); want != have {
+			t.Errorf("expected %d healthy backends; got: %d", want, have)
+		}
+		if want, have := int64(2), attrs["balancers.backends.total"].AsInt64(); want != have {
+			t.Errorf("expected %d backends; got: %d", want, have)
+		}
+	}
+
+	// The first attempt hits the backend that hangs up
+	if want, have := codes.Error, spans[0].Status.Code; want != have {
+		t.Errorf("expected status %v; got: %v", want, have)
+	}
+	attrs := attributesOf(spans[1].Attributes)
+	if want, have := int64(200), attrs["http.response.status_code"].AsInt64(); want != have {
+		t.Errorf("expected status code %d; got: %d", want, have)
+	}
+	if want, have := balancer.Stats()[1].URL, attrs["balancers.backend"].AsString(); want != have {
+		t.Errorf("expected backend %q; got: %q", want, have)
+	}
+	if !strings.Contains(traceparent, traceID.String()) || !strings.Contains(traceparent, spans[1].SpanContext.SpanID().String()) {
+		t.Errorf("expected traceparent of the second attempt; got: %q", traceparent)
+	}
+}
+
+func TestTransportAnnotate(t *testing.T) {
+	var traceparent string
+	balancer, cleanup := newTestBalancer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer cleanup()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	transport := balancers.NewTransport(balancer)
+	transport.Retries = 1
+	transport.Base = NewTransport(nil, Options{TracerProvider: provider, Annotate: true})
+	client := &http.Client{Transport: transport}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	req, _ := http.NewRequest("GET", "http://example.com/search", nil)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if want, have := 1, len(spans); want != have {
+		t.Fatalf("expected %d span; got: %d", want, have)
+	}
+	var names []string
+	for _, ev := range spans[0].Events {
+		names = append(names, ev.Name)
+	}
+	if want, have := "balancers.attempt balancers.error balancers.attempt", strings.Join(names, " "); want != have {
+		t.Errorf("expected events %q; got: %q", want, have)
+	}
+	if !strings.Contains(traceparent, parent.SpanContext().SpanID().String()) {
+		t.Errorf("expected traceparent of the parent span; got: %q", traceparent)
+	}
+}
+
+func TestTransportWithoutBalancer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	client := &http.Client{Transport: NewTransport(nil, Options{TracerProvider: provider})}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if want, have := 0, len(exporter.GetSpans()); want != have {
+		t.Errorf("expected %d spans; got: %d", want, have)
+	}
+}
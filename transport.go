@@ -8,45 +8,179 @@
 package balancers
 
 import (
+	"context"
 	"io"
+	"log/slog"
 	"net/http"
 	"sync"
 )
 
 // Transport implements a http Transport for a HTTP load balancer.
 type Transport struct {
+	// Base sends the requests. It defaults to http.DefaultTransport.
+	// If the balancer is a HealthCheckTransporter, Base is also used to
+	// check the health of its connections, so that hosts are checked with
+	// the same TLS and proxy settings that are used for requests. Set Base
+	// before the first request. The balancer starts to use it with the
+	// first request, which does not wait for the connections to be checked.
 	Base http.RoundTripper
 
+	// Retries is the number of times a request is sent to another
+	// connection if it fails without a response, e.g. because the host
+	// is down. Only idempotent requests whose body can be sent again
+	// are retried. Responses are never retried, whatever their status.
+	Retries int
+
+	// Observer, if set, is notified about every request, e.g. to record
+	// metrics.
+	Observer Observer
+
+	// Logger, if set, logs retries at warn level, and requests that fail
+	// because the balancer has no connection at debug level. Balancers
+	// like roundrobin.Balancer log the latter at warn level along with
+	// the number of healthy connections.
+	Logger *slog.Logger
+
+	// Clock measures the duration of requests that is passed to the
+	// Observer and recorded by the connection. It defaults to the Clock of
+	// the Scheduler of a HttpConnection and to RealClock otherwise.
+	Clock Clock
+
 	balancer Balancer
+	wireBase sync.Once // passes Base to the balancer on the first request
 
 	mu     sync.Mutex
 	modReq map[*http.Request]*http.Request
 }
 
+// NewTransport returns a Transport that sends requests to the connections
+// of the balancer.
+func NewTransport(b Balancer) *Transport {
+	return &Transport{balancer: b}
+}
+
 // RoundTrip is the core of the balancers package. It accepts a request,
 // replaces host, scheme, and port with the URl provided by the balancer,
 // executes it and returns the response to the caller.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	conn, err := t.balancer.Get()
-	if err != nil {
-		return nil, err
+	t.wireBase.Do(func() {
+		if ht, ok := t.balancer.(HealthCheckTransporter); ok && t.Base != nil {
+			ht.SetHealthCheckTransport(t.Base)
+		}
+	})
+	body := r.Body
+	for attempt := 0; ; attempt++ {
+		conn, err := t.balancer.Get()
+		if err != nil {
+			if t.Observer != nil {
+				t.Observer.NoConnection(r, err)
+			}
+			if t.Logger != nil {
+				attrs := append([]slog.Attr{slog.String("method", r.Method), slog.String("path", r.URL.Path)}, ErrorAttrs(err)...)
+				t.Logger.LogAttrs(r.Context(), slog.LevelDebug, "no connection", attrs...)
+			}
+			return nil, err
+		}
+		info := &RequestInfo{
+			Balancer: t.balancer,
+			Conn:     conn,
+			Attempt:  attempt + 1,
+			Retries:  t.Retries,
+		}
+		if sr, ok := t.balancer.(StateReporter); ok {
+			state := sr.State()
+			info.State = &state
+		}
+		res, err := t.send(r, body, info)
+		if err == nil || attempt >= t.Retries || !isReplayable(r) || r.Context().Err() != nil {
+			return res, err
+		}
+		if t.Logger != nil {
+			attrs := append([]slog.Attr{backendAttr(conn.URL()), slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.Int("attempt", attempt+1)}, ErrorAttrs(err)...)
+			t.Logger.LogAttrs(r.Context(), slog.LevelWarn, "retrying request", attrs...)
+		}
+		if r.GetBody != nil {
+			if body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
 	}
+}
+
+// RequestInfo describes an attempt of a Transport to send a request.
+// It is available to the Base of the Transport, e.g. for tracing, by means
+// of RequestInfoFromContext.
+type RequestInfo struct {
+	// Balancer of the Transport.
+	Balancer Balancer
+	// Conn is the connection chosen by the balancer.
+	Conn Connection
+	// Attempt is 1 for the first attempt and incremented for every retry.
+	Attempt int
+	// Retries is the maximum number of retries of the Transport.
+	Retries int
+	// State is the state of the balancer after it chose Conn, if the
+	// balancer is a StateReporter, and nil otherwise.
+	State *BalancerState
+}
+
+type requestInfoKey struct{}
 
+// RequestInfoFromContext returns the RequestInfo of a request sent by a
+// Transport, if any.
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// send sends the request with the given body to the connection of info.
+func (t *Transport) send(r *http.Request, body io.ReadCloser, info *RequestInfo) (*http.Response, error) {
+	conn := info.Conn
 	rc := cloneRequest(r)
+	rc.Body = body
+	rc = rc.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
 	if err := modifyRequest(rc, conn); err != nil {
 		return nil, err
 	}
 	t.setModReq(r, rc)
 
+	// Keep track of requests in flight, e.g. for draining
+	tracker, _ := conn.(Tracker)
+	if tracker != nil {
+		tracker.Acquire()
+	}
+	if t.Observer != nil {
+		t.Observer.RequestStarted(rc, conn)
+	}
+	finish := func() {
+		t.setModReq(r, nil)
+		if tracker != nil {
+			tracker.Release()
+		}
+		if t.Observer != nil {
+			t.Observer.RequestFinished(rc, conn)
+		}
+	}
+
+	clock := t.clock(conn)
+	start := clock.Now()
 	res, err := t.base().RoundTrip(rc)
+	elapsed := clock.Now().Sub(start)
+	if recorder, ok := conn.(RequestRecorder); ok {
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode
+		}
+		recorder.RecordRequest(statusCode, err, elapsed)
+	}
+	if t.Observer != nil {
+		t.Observer.RequestDone(rc, conn, res, err, elapsed)
+	}
 	if err != nil {
-		t.setModReq(r, nil)
+		finish()
 		return nil, err
 	}
-	res.Body = &onEOFReader{
-		rc: res.Body,
-		fn: func() { t.setModReq(r, nil) },
-	}
+	res.Body = &onEOFReader{rc: res.Body, fn: finish}
 	return res, nil
 }
 
@@ -64,6 +198,20 @@ func (t *Transport) CancelRequest(r *http.Request) {
 	}
 }
 
+// clock returns the Clock that measures the duration of requests to conn.
+func (t *Transport) clock(conn Connection) Clock {
+	if t.Clock != nil {
+		return t.Clock
+	}
+	if c, ok := conn.(*HttpConnection); ok {
+		c.Lock()
+		scheduler := c.scheduler
+		c.Unlock()
+		return scheduler.getClock()
+	}
+	return RealClock
+}
+
 func (t *Transport) base() http.RoundTripper {
 	if t.Base != nil {
 		return t.Base
@@ -71,6 +219,23 @@ func (t *Transport) base() http.RoundTripper {
 	return http.DefaultTransport
 }
 
+// isReplayable returns true if the request may be sent again after
+// it failed, like in the Transport of net/http.
+func isReplayable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return false
+	}
+	switch r.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = r.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
 // modifyRequest exchanges the HTTP request scheme, host, and userinfo
 // by the URL the connection returns.
 func modifyRequest(r *http.Request, conn Connection) error {
@@ -4,9 +4,13 @@
 package balancers
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -93,3 +97,149 @@ func TestModifyRequest(t *testing.T) {
 		}
 	}
 }
+
+type testBalancer struct {
+	conn Connection
+}
+
+func (b *testBalancer) Get() (Connection, error)  { return b.conn, nil }
+func (b *testBalancer) Connections() []Connection { return []Connection{b.conn} }
+
+func TestTransportTracksRequestsInFlight(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url)
+	defer conn.Close()
+
+	client := NewClient(&testBalancer{conn: conn})
+	res, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.InFlight() != 1 {
+		t.Fatalf("expected %d request in flight; got: %d", 1, conn.InFlight())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if conn.InFlight() != 0 {
+		t.Fatalf("expected %d requests in flight; got: %d", 0, conn.InFlight())
+	}
+
+	// Failed requests must be released as well
+	server.Close()
+	if _, err := client.Get("http://example.com/"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+	if conn.InFlight() != 0 {
+		t.Fatalf("expected %d requests in flight; got: %d", 0, conn.InFlight())
+	}
+}
+
+// sequenceBalancer returns its connections in order.
+type sequenceBalancer struct {
+	conns []Connection
+	idx   int
+}
+
+func (b *sequenceBalancer) Get() (Connection, error) {
+	conn := b.conns[b.idx%len(b.conns)]
+	b.idx++
+	return conn, nil
+}
+
+func (b *sequenceBalancer) Connections() []Connection { return b.conns }
+
+func TestTransportRetries(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+		}
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	up, _ := url.Parse(server.URL)
+	dead, _ := url.Parse(down.URL)
+	newBalancer := func() *sequenceBalancer {
+		return &sequenceBalancer{conns: []Connection{
+			NewHttpConnection(dead).HeartbeatDuration(0),
+			NewHttpConnection(up).HeartbeatDuration(0),
+		}}
+	}
+
+	// Without retries, the first failure is returned
+	client := &http.Client{Transport: NewTransport(newBalancer())}
+	if _, err := client.Get("http://example.com/"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+
+	// With retries, the request is sent to the next connection
+	transport := NewTransport(newBalancer())
+	transport.Retries = 1
+	client = &http.Client{Transport: transport}
+	res, err := client.Post("http://example.com/api", "text/plain", strings.NewReader("not idempotent"))
+	if err == nil {
+		res.Body.Close()
+		t.Fatal("expected POST request to fail")
+	}
+	req, _ := http.NewRequest("PUT", "http://example.com/api", strings.NewReader("Hello"))
+	req.Header.Set("Idempotency-Key", "1")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if want, have := "[Hello]", fmt.Sprint(bodies); want != have {
+		t.Errorf("expected bodies %s; got: %s", want, have)
+	}
+}
+
+// emptyBalancer has no connections.
+type emptyBalancer struct{}
+
+func (emptyBalancer) Get() (Connection, error)  { return nil, ErrNoConn }
+func (emptyBalancer) Connections() []Connection { return nil }
+
+func TestTransportLogger(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	up, _ := url.Parse(server.URL)
+	dead, _ := url.Parse(down.URL)
+	var buf bytes.Buffer
+	transport := NewTransport(&sequenceBalancer{conns: []Connection{
+		NewHttpConnection(dead).HeartbeatDuration(0),
+		NewHttpConnection(up).HeartbeatDuration(0),
+	}})
+	transport.Retries = 1
+	transport.Logger = newTestLogger(&buf)
+	res, err := (&http.Client{Transport: transport}).Get("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	want := fmt.Sprintf(`level=WARN msg="retrying request" backend=%s method=GET path=/api attempt=1 error=`, down.URL)
+	if have := buf.String(); !strings.HasPrefix(have, want) || !strings.Contains(have, "cause=error") {
+		t.Errorf("expected log to start with %s; got: %s", want, have)
+	}
+
+	buf.Reset()
+	transport = NewTransport(emptyBalancer{})
+	transport.Logger = newTestLogger(&buf)
+	if _, err := (&http.Client{Transport: transport}).Get("http://example.com/api"); err == nil {
+		t.Fatal("expected request to fail")
+	}
+	want = `level=DEBUG msg="no connection" method=GET path=/api error="no connection" cause=no_connection` + "\n"
+	if have := buf.String(); have != want {
+		t.Errorf("expected log %s; got: %s", want, have)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NewHttpConnectionFromURL creates a new HTTP connection from a URL that
+// may contain options for the connection in its query string, e.g.
+// "https://host:9200?weight=3&zone=eu-1&health=/healthz". The options are:
+//
+//	weight=N        the weight of the connection (see SetWeight)
+//	priority=N      the priority of the connection (see SetPriority)
+//	zone=Z          shortcut for label.zone=Z
+//	label.K=V       the label K with value V (see SetLabels)
+//	health=PATH     the path of the health check (see HealthCheck)
+//
+// The options are removed from the URL of the connection, while other
+// query parameters are kept. Like NewHttpConnection, it checks the
+// connection immediately and then periodically.
+func NewHttpConnectionFromURL(rawurl string) (*HttpConnection, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	c := newHttpConnection(u)
+	if u.RawQuery == "" {
+		c.start()
+		return c, nil
+	}
+
+	q := u.Query()
+	found := false
+	for key, values := range q {
+		value := values[len(values)-1]
+		switch {
+		case key == "weight":
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("balancers: invalid weight %q in URL %q", value, rawurl)
+			}
+			c.weight = weight
+		case key == "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("balancers: invalid priority %q in URL %q", value, rawurl)
+			}
+			c.priority = priority
+		case key == "zone" || strings.HasPrefix(key, "label."):
+			name := strings.TrimPrefix(key, "label.")
+			if name == "" {
+				return nil, fmt.Errorf("balancers: missing label name in URL %q", rawurl)
+			}
+			if c.labels == nil {
+				c.labels = make(map[string]string)
+			}
+			c.labels[name] = value
+		case key == "health":
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("balancers: invalid health check path %q in URL %q", value, rawurl)
+			}
+			c.checker = &HealthCheck{Path: value}
+		default:
+			continue
+		}
+		q.Del(key)
+		found = true
+	}
+	if found {
+		u.RawQuery = q.Encode()
+	}
+	c.start()
+	return c, nil
+}
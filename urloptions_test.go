@@ -0,0 +1,74 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHttpConnectionFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := NewHttpConnectionFromURL(server.URL + "?weight=3&priority=1&zone=eu-1&label.rack=r7&health=/healthz&pretty=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if want, have := server.URL+"?pretty=true", conn.URL().String(); want != have {
+		t.Errorf("expected URL %q; got: %q", want, have)
+	}
+	if want, have := 3, conn.Weight(); want != have {
+		t.Errorf("expected weight %d; got: %d", want, have)
+	}
+	if want, have := 1, conn.Priority(); want != have {
+		t.Errorf("expected priority %d; got: %d", want, have)
+	}
+	labels := conn.Labels()
+	if len(labels) != 2 || labels["zone"] != "eu-1" || labels["rack"] != "r7" {
+		t.Errorf("expected labels zone=eu-1 and rack=r7; got: %v", labels)
+	}
+	// The default health check would fail with 404
+	if conn.IsBroken() {
+		t.Errorf("expected connection to be healthy; got: %v", conn.State().LastError)
+	}
+}
+
+func TestNewHttpConnectionFromURLWithoutOptions(t *testing.T) {
+	conn, err := NewHttpConnectionFromURL("http://127.0.0.1:9200/prefix?b=2&a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if want, have := "http://127.0.0.1:9200/prefix?b=2&a=1", conn.URL().String(); want != have {
+		t.Errorf("expected URL %q; got: %q", want, have)
+	}
+	if want, have := 1, conn.Weight(); want != have {
+		t.Errorf("expected weight %d; got: %d", want, have)
+	}
+}
+
+func TestNewHttpConnectionFromURLErrors(t *testing.T) {
+	tests := []string{
+		"http://127.0.0.1:9200?weight=heavy",
+		"http://127.0.0.1:9200?weight=0",
+		"http://127.0.0.1:9200?priority=high",
+		"http://127.0.0.1:9200?label.=x",
+		"http://127.0.0.1:9200?health=healthz",
+		"http://127.0.0.1:9200/%zz",
+	}
+	for _, rawurl := range tests {
+		if conn, err := NewHttpConnectionFromURL(rawurl); err == nil {
+			conn.Close()
+			t.Errorf("expected error for %q", rawurl)
+		}
+	}
+}